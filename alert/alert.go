@@ -0,0 +1,276 @@
+// Package alert evaluates alerting rules against collected stats.
+package alert
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+// notifyTimeout bounds the delivery time of a single notification.
+const notifyTimeout = time.Minute
+
+// Rule types.
+const (
+	// NoTraffic fires if the matched counters see no traffic for Window.
+	NoTraffic = "no_traffic"
+	// TrafficAbove fires if the matched counters see more than Threshold
+	// bytes within Window.
+	TrafficAbove = "traffic_above"
+	// Unreachable fires if Scrapes consecutive scrapes fail.
+	Unreachable = "unreachable"
+)
+
+// Rule is an alerting rule. Traffic rules match counters by Kind, Target
+// and Direction, where empty fields match anything. Without a Target, the
+// rule is evaluated separately for every user or tag.
+type Rule struct {
+	Name string
+	Type string
+	// Server restricts the rule to the target of this name.
+	Server    string
+	Kind      string
+	Target    string
+	Direction string
+	Threshold int64
+	Window    time.Duration
+	Scrapes   int
+}
+
+func (r *Rule) match(name stats.Name) bool {
+	return name.Kind != "" &&
+		(r.Kind == "" || r.Kind == name.Kind) &&
+		(r.Target == "" || r.Target == name.Target) &&
+		(r.Direction == "" || r.Direction == name.Direction)
+}
+
+// Status of an alert.
+const (
+	Firing   = "firing"
+	Resolved = "resolved"
+)
+
+// Notification reports an alert starting to fire or being resolved.
+type Notification struct {
+	Rule    string    `json:"rule"`
+	Status  string    `json:"status"`
+	Server  string    `json:"server"`
+	Target  string    `json:"target,omitempty"`
+	Message string    `json:"message"`
+	Since   time.Time `json:"since"`
+	Time    time.Time `json:"time"`
+}
+
+// Notifier delivers notifications.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+type sample struct {
+	time  time.Time
+	value int64
+}
+
+// instance is the state of a rule for one server and target.
+type instance struct {
+	firstSeen time.Time
+	samples   []sample
+	failures  int
+	firing    bool
+	since     time.Time
+}
+
+func (in *instance) sum(now time.Time, window time.Duration) int64 {
+	cutoff := now.Add(-window)
+	i := 0
+	for i < len(in.samples) && !in.samples[i].time.After(cutoff) {
+		i++
+	}
+	in.samples = in.samples[i:]
+	var sum int64
+	for _, s := range in.samples {
+		sum += s.value
+	}
+	return sum
+}
+
+type instanceKey struct {
+	rule   int
+	server string
+	target string
+}
+
+// Engine evaluates rules on every scrape and notifies about alerts changing
+// state. An alert is notified once when it starts firing and once when it
+// is resolved.
+type Engine struct {
+	rules     []Rule
+	notifiers []Notifier
+	logger    logrus.FieldLogger
+
+	mu        sync.Mutex
+	instances map[instanceKey]*instance
+	// closed is set once the engine is closed, after which scrapes are
+	// ignored.
+	closed bool
+
+	wg sync.WaitGroup
+}
+
+// NewEngine creates an engine for the rules.
+func NewEngine(rules []Rule, notifiers []Notifier, logger logrus.FieldLogger) *Engine {
+	return &Engine{
+		rules:     rules,
+		notifiers: notifiers,
+		logger:    logger,
+		instances: make(map[instanceKey]*instance),
+	}
+}
+
+func (e *Engine) instance(k instanceKey, now time.Time) *instance {
+	in, ok := e.instances[k]
+	if !ok {
+		in = &instance{firstSeen: now}
+		e.instances[k] = in
+	}
+	return in
+}
+
+// Observe evaluates the rules after a scrape of server at time now. The
+// batch is nil if the scrape failed with err.
+func (e *Engine) Observe(server string, now time.Time, b *stats.Batch, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+
+	for i := range e.rules {
+		r := &e.rules[i]
+		if r.Server != "" && r.Server != server {
+			continue
+		}
+		if r.Type == Unreachable {
+			in := e.instance(instanceKey{rule: i, server: server}, now)
+			if err != nil {
+				in.failures++
+			} else {
+				in.failures = 0
+			}
+			msg := fmt.Sprintf("V2Ray API of %s unreachable for %d scrapes: %v", server, in.failures, err)
+			e.set(r, server, "", in, in.failures >= r.Scrapes, now, msg)
+			continue
+		}
+		if b != nil {
+			e.evalTraffic(i, server, now, b)
+		}
+	}
+}
+
+func (e *Engine) evalTraffic(i int, server string, now time.Time, b *stats.Batch) {
+	r := &e.rules[i]
+
+	// Sum the matched counters per target. A rule for a specific target is
+	// evaluated even if V2Ray does not report its counters.
+	traffic := make(map[string]int64)
+	if r.Target != "" {
+		traffic[r.Target] = 0
+	}
+	for _, s := range b.Stats {
+		name, _ := stats.ParseName(s.Name)
+		if r.match(name) {
+			traffic[name.Target] += s.Value
+		}
+	}
+	for target, value := range traffic {
+		in := e.instance(instanceKey{rule: i, server: server, target: target}, now)
+		in.samples = append(in.samples, sample{time: now, value: value})
+	}
+
+	// Evaluate every instance of the rule, including targets that were not
+	// part of this batch.
+	for k, in := range e.instances {
+		if k.rule != i || k.server != server {
+			continue
+		}
+		sum := in.sum(now, r.Window)
+		subject := describe(r, k.target, server)
+		switch r.Type {
+		case NoTraffic:
+			active := now.Sub(in.firstSeen) >= r.Window && sum == 0
+			msg := fmt.Sprintf("%s had no traffic for %s", subject, r.Window)
+			e.set(r, server, k.target, in, active, now, msg)
+		case TrafficAbove:
+			msg := fmt.Sprintf("%s had %s of traffic within %s, more than %s", subject,
+				stats.FormatBytes(sum), r.Window, stats.FormatBytes(r.Threshold))
+			e.set(r, server, k.target, in, sum > r.Threshold, now, msg)
+		}
+	}
+}
+
+func describe(r *Rule, target, server string) string {
+	kind := r.Kind
+	if kind == "" {
+		kind = "counter"
+	}
+	s := fmt.Sprintf("%s %s on %s", kind, target, server)
+	if r.Direction != "" {
+		s += " (" + r.Direction + ")"
+	}
+	return s
+}
+
+// set updates the state of an alert instance and notifies about changes.
+// e.mu must be held.
+func (e *Engine) set(r *Rule, server, target string, in *instance, active bool, now time.Time, msg string) {
+	if active == in.firing {
+		return
+	}
+	in.firing = active
+	n := Notification{
+		Rule:    r.Name,
+		Status:  Firing,
+		Server:  server,
+		Target:  target,
+		Message: msg,
+		Since:   now,
+		Time:    now,
+	}
+	if active {
+		in.since = now
+	} else {
+		n.Status = Resolved
+		n.Message = "resolved: " + r.Name
+		if target != "" {
+			n.Message += " for " + target
+		}
+		n.Message += " on " + server
+		n.Since = in.since
+	}
+	e.logger.Warnf("Alert %s %s: %s", r.Name, n.Status, n.Message)
+	for _, nf := range e.notifiers {
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := nf.Notify(ctx, n); err != nil {
+				e.logger.Errorf("Failed to deliver alert %s: %v", r.Name, err)
+			}
+		}()
+	}
+}
+
+// Close stops evaluating rules and waits for pending notifications to be
+// delivered.
+func (e *Engine) Close() {
+	e.mu.Lock()
+	e.closed = true
+	e.mu.Unlock()
+	e.wg.Wait()
+}
@@ -0,0 +1,211 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.rikki.moe/v2stat/notify"
+	"go.rikki.moe/v2stat/stats"
+)
+
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []Notification
+}
+
+func (r *recordingNotifier) Notify(ctx context.Context, n Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, n)
+	return nil
+}
+
+// take returns the notifications sent since the last call, once the engine
+// delivered them.
+func (r *recordingNotifier) take(e *Engine) []Notification {
+	e.wg.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sent := r.sent
+	r.sent = nil
+	return sent
+}
+
+func newTestEngine(rules ...Rule) (*Engine, *recordingNotifier) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	n := &recordingNotifier{}
+	return NewEngine(rules, []Notifier{n}, logger), n
+}
+
+func userStat(email string, value int64) stats.Stat {
+	return stats.Stat{Name: stats.KindUser + stats.Separator + email + stats.Separator + "traffic" + stats.Separator + stats.DirectionUplink, Value: value}
+}
+
+func batch(server string, s ...stats.Stat) *stats.Batch {
+	return &stats.Batch{Server: server, Stats: s}
+}
+
+func TestTrafficAboveFiresOnceAndResolves(t *testing.T) {
+	e, n := newTestEngine(Rule{Name: "heavy", Type: TrafficAbove, Kind: stats.KindUser, Threshold: 100, Window: time.Minute})
+	t0 := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	e.Observe("s", t0, batch("s", userStat("alice@x", 50)), nil)
+	if sent := n.take(e); len(sent) != 0 {
+		t.Fatalf("notified below the threshold: %+v", sent)
+	}
+	e.Observe("s", t0.Add(10*time.Second), batch("s", userStat("alice@x", 80)), nil)
+	sent := n.take(e)
+	if len(sent) != 1 || sent[0].Status != Firing || sent[0].Target != "alice@x" {
+		t.Fatalf("got %+v, want alice@x firing", sent)
+	}
+	since := sent[0].Since
+
+	// Staying above the threshold is not notified again.
+	e.Observe("s", t0.Add(20*time.Second), batch("s", userStat("alice@x", 10)), nil)
+	if sent := n.take(e); len(sent) != 0 {
+		t.Fatalf("notified again while firing: %+v", sent)
+	}
+
+	// The samples above the threshold leave the window.
+	e.Observe("s", t0.Add(2*time.Minute), batch("s", userStat("alice@x", 0)), nil)
+	sent = n.take(e)
+	if len(sent) != 1 || sent[0].Status != Resolved || !sent[0].Since.Equal(since) {
+		t.Fatalf("got %+v, want alice@x resolved since %s", sent, since)
+	}
+}
+
+func TestTrafficAbovePerTarget(t *testing.T) {
+	e, n := newTestEngine(Rule{Name: "heavy", Type: TrafficAbove, Kind: stats.KindUser, Threshold: 100, Window: time.Minute})
+	t0 := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	e.Observe("a", t0, batch("a", userStat("alice@x", 200), userStat("bob@x", 50)), nil)
+	e.Observe("b", t0, batch("b", userStat("alice@x", 50)), nil)
+	sent := n.take(e)
+	if len(sent) != 1 || sent[0].Server != "a" || sent[0].Target != "alice@x" {
+		t.Fatalf("got %+v, want alice@x on a firing only", sent)
+	}
+
+	// A rule for one server ignores the others.
+	e, n = newTestEngine(Rule{Name: "heavy", Type: TrafficAbove, Server: "b", Threshold: 100, Window: time.Minute})
+	e.Observe("a", t0, batch("a", userStat("alice@x", 200)), nil)
+	if sent := n.take(e); len(sent) != 0 {
+		t.Fatalf("rule for b fired on a: %+v", sent)
+	}
+}
+
+func TestNoTrafficWarmUp(t *testing.T) {
+	e, n := newTestEngine(Rule{Name: "idle", Type: NoTraffic, Kind: stats.KindUser, Window: time.Minute})
+	t0 := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	// A target is not idle before it was watched for a full window.
+	e.Observe("s", t0, batch("s", userStat("alice@x", 0)), nil)
+	e.Observe("s", t0.Add(30*time.Second), batch("s", userStat("alice@x", 0)), nil)
+	if sent := n.take(e); len(sent) != 0 {
+		t.Fatalf("notified within the first window: %+v", sent)
+	}
+
+	// bob@x shows up late and starts its own window.
+	e.Observe("s", t0.Add(time.Minute), batch("s", userStat("alice@x", 0), userStat("bob@x", 0)), nil)
+	sent := n.take(e)
+	if len(sent) != 1 || sent[0].Status != Firing || sent[0].Target != "alice@x" {
+		t.Fatalf("got %+v, want alice@x firing", sent)
+	}
+
+	e.Observe("s", t0.Add(90*time.Second), batch("s", userStat("alice@x", 10)), nil)
+	sent = n.take(e)
+	if len(sent) != 1 || sent[0].Status != Resolved || sent[0].Target != "alice@x" {
+		t.Fatalf("got %+v, want alice@x resolved", sent)
+	}
+
+	// Targets missing from a batch had no traffic.
+	e.Observe("s", t0.Add(2*time.Minute), batch("s"), nil)
+	sent = n.take(e)
+	if len(sent) != 1 || sent[0].Status != Firing || sent[0].Target != "bob@x" {
+		t.Fatalf("got %+v, want bob@x firing", sent)
+	}
+}
+
+func TestUnreachableCountsConsecutiveFailures(t *testing.T) {
+	e, n := newTestEngine(Rule{Name: "down", Type: Unreachable, Scrapes: 3})
+	t0 := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	errDown := errors.New("connection refused")
+	observe := func(i int, err error) {
+		now := t0.Add(time.Duration(i) * time.Minute)
+		var b *stats.Batch
+		if err == nil {
+			b = batch("s")
+		}
+		e.Observe("s", now, b, err)
+	}
+
+	// A success in between starts the count over.
+	observe(0, errDown)
+	observe(1, errDown)
+	observe(2, nil)
+	observe(3, errDown)
+	observe(4, errDown)
+	if sent := n.take(e); len(sent) != 0 {
+		t.Fatalf("notified before 3 consecutive failures: %+v", sent)
+	}
+	observe(5, errDown)
+	observe(6, errDown)
+	sent := n.take(e)
+	if len(sent) != 1 || sent[0].Status != Firing || !sent[0].Since.Equal(t0.Add(5*time.Minute)) {
+		t.Fatalf("got %+v, want one firing notification", sent)
+	}
+	observe(7, nil)
+	sent = n.take(e)
+	if len(sent) != 1 || sent[0].Status != Resolved {
+		t.Fatalf("got %+v, want resolved", sent)
+	}
+}
+
+func TestEmailGivesUpOnHangingServer(t *testing.T) {
+	// The server accepts connections and holds them open until the test ends,
+	// but never greets.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	email := &Email{SMTP: notify.SMTP{Addr: ln.Addr().String(), From: "v2stat@x"}, To: []string{"ops@x"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- email.Notify(ctx, Notification{Time: time.Now()}) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("notify succeeded without a greeting")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notify did not give up after its deadline")
+	}
+}
+
+func TestClosedEngineIgnoresScrapes(t *testing.T) {
+	e, n := newTestEngine(Rule{Name: "down", Type: Unreachable, Scrapes: 1})
+	e.Close()
+	e.Observe("s", time.Now(), nil, errors.New("connection refused"))
+	if sent := n.take(e); len(sent) != 0 {
+		t.Fatalf("closed engine notified: %+v", sent)
+	}
+}
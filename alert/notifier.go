@@ -0,0 +1,45 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"go.rikki.moe/v2stat/notify"
+)
+
+// Writer writes notifications as lines of text, e.g. to stdout.
+type Writer struct {
+	W io.Writer
+}
+
+func (w *Writer) Notify(ctx context.Context, n Notification) error {
+	_, err := fmt.Fprintf(w.W, "%s [%s] %s: %s\n", n.Time.Format(time.RFC3339), n.Status, n.Rule, n.Message)
+	return err
+}
+
+// Webhook posts notifications as JSON to a URL.
+type Webhook struct {
+	URL string
+}
+
+func (w *Webhook) Notify(ctx context.Context, n Notification) error {
+	return notify.Webhook(ctx, w.URL, n)
+}
+
+// Email mails notifications.
+type Email struct {
+	SMTP notify.SMTP
+	To   []string
+}
+
+func (e *Email) Notify(ctx context.Context, n Notification) error {
+	subject := fmt.Sprintf("[v2stat] %s: %s on %s", n.Status, n.Rule, n.Server)
+	body := fmt.Sprintf("%s\n\nRule:   %s\nServer: %s\nSince:  %s\n",
+		n.Message, n.Rule, n.Server, n.Since.Format(time.RFC3339))
+	if n.Target != "" {
+		body += fmt.Sprintf("Target: %s\n", n.Target)
+	}
+	return notify.Mail(ctx, e.SMTP, e.To, subject, body)
+}
@@ -0,0 +1,391 @@
+// Package api serves collected stats over an HTTP JSON API, for systems such
+// as billing portals to fetch usage from. It serves both the values of the
+// latest scrapes, which it receives as a sink, and history read from the
+// SQLite database.
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.rikki.moe/v2stat/internal/httpjson"
+	"go.rikki.moe/v2stat/stats"
+	"go.rikki.moe/v2stat/store"
+)
+
+const (
+	// defaultPerPage and maxPerPage bound the page size of list endpoints.
+	defaultPerPage = 100
+	maxPerPage     = 1000
+	// maxPoints is the number of steps a usage history may have.
+	maxPoints = 10000
+)
+
+// API is an http.Handler serving the API, and a sink recording the latest
+// scrape of every server. Its endpoints are relative to the path it is
+// mounted on.
+type API struct {
+	db     *store.DB
+	tokens [][]byte
+	log    logrus.FieldLogger
+	mux    *http.ServeMux
+
+	mu sync.Mutex
+	// latest is the latest batch of every server.
+	latest map[string]*stats.Batch
+}
+
+// New creates an API reading history from db. Clients have to authenticate
+// with one of tokens as a bearer token.
+func New(db *store.DB, tokens []string, logger logrus.FieldLogger) *API {
+	a := &API{
+		db:     db,
+		log:    logger,
+		mux:    http.NewServeMux(),
+		latest: make(map[string]*stats.Batch),
+	}
+	for _, t := range tokens {
+		a.tokens = append(a.tokens, []byte(t))
+	}
+	a.mux.HandleFunc("GET /users", a.list(stats.KindUser))
+	a.mux.HandleFunc("GET /users/{email}/usage", a.usage)
+	a.mux.HandleFunc("GET /inbounds", a.list(stats.KindInbound))
+	a.mux.HandleFunc("GET /sys", a.sys)
+	return a
+}
+
+// ServeHTTP authenticates the request and serves it.
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="v2stat"`)
+		httpjson.Error(w, http.StatusUnauthorized, fmt.Errorf("invalid or missing token"))
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *API) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	var match int
+	for _, t := range a.tokens {
+		match |= subtle.ConstantTimeCompare([]byte(token), t)
+	}
+	return match == 1
+}
+
+// Write records b as the latest scrape of its server.
+func (a *API) Write(ctx context.Context, b *stats.Batch) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.latest[b.Server] = b
+	return nil
+}
+
+// Flush is a no-op.
+func (a *API) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close is a no-op.
+func (a *API) Close() error {
+	return nil
+}
+
+// latestBatches returns the latest batch of every server, or only of server
+// if it is set, ordered by server.
+func (a *API) latestBatches(server string) []*stats.Batch {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var out []*stats.Batch
+	for name, b := range a.latest {
+		if server == "" || name == server {
+			out = append(out, b)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Server < out[j].Server })
+	return out
+}
+
+type entry struct {
+	Name string `json:"name"`
+	// Latest is the traffic in the latest scrape of every server, nil if
+	// there was none since v2stat started.
+	Latest *stats.Traffic `json:"latest"`
+	// Usage is the traffic within the requested time range.
+	Usage stats.Traffic `json:"usage"`
+}
+
+// page is a page of a list.
+type page struct {
+	From    time.Time   `json:"from"`
+	To      time.Time   `json:"to"`
+	Page    int         `json:"page"`
+	PerPage int         `json:"per_page"`
+	Total   int         `json:"total"`
+	Data    interface{} `json:"data"`
+}
+
+// list returns a handler listing the users or inbounds with their latest and
+// historical traffic, ordered by name.
+func (a *API) list(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, to, ok := timeRange(w, r)
+		if !ok {
+			return
+		}
+		pageNum, perPage, ok := pageParams(w, r)
+		if !ok {
+			return
+		}
+		server := r.URL.Query().Get("server")
+		totals, err := a.db.Totals(r.Context(), from, to, server)
+		if err != nil {
+			a.fail(w, err)
+			return
+		}
+
+		byName := make(map[string]*entry)
+		get := func(name string) *entry {
+			e, ok := byName[name]
+			if !ok {
+				e = &entry{Name: name}
+				byName[name] = e
+			}
+			return e
+		}
+		for _, u := range stats.Aggregate(totals) {
+			if u.Kind == kind {
+				get(u.Target).Usage = u.Traffic()
+			}
+		}
+		var latest []stats.Stat
+		for _, b := range a.latestBatches(server) {
+			latest = append(latest, b.Stats...)
+		}
+		for _, u := range stats.Aggregate(latest) {
+			if u.Kind == kind {
+				t := u.Traffic()
+				get(u.Target).Latest = &t
+			}
+		}
+
+		entries := make([]entry, 0, len(byName))
+		for _, e := range byName {
+			entries = append(entries, *e)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		httpjson.Write(w, page{
+			From:    from,
+			To:      to,
+			Page:    pageNum,
+			PerPage: perPage,
+			Total:   len(entries),
+			Data:    paginate(entries, pageNum, perPage),
+		})
+	}
+}
+
+type point struct {
+	Time time.Time `json:"time"`
+	stats.Traffic
+}
+
+// usage returns the traffic of a user over time, in buckets of step. Steps
+// are aligned to multiples of step since the Unix epoch, so daily steps
+// start at midnight UTC.
+func (a *API) usage(w http.ResponseWriter, r *http.Request) {
+	email := r.PathValue("email")
+	from, to, ok := timeRange(w, r)
+	if !ok {
+		return
+	}
+	step := time.Hour
+	if v := r.URL.Query().Get("step"); v != "" {
+		var err error
+		if step, err = stats.ParseDuration(v); err != nil {
+			httpjson.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		if step < time.Second {
+			httpjson.Error(w, http.StatusBadRequest, fmt.Errorf("step must be at least 1s"))
+			return
+		}
+	}
+	step = step.Truncate(time.Second)
+	secs := int64(step / time.Second)
+	from = time.Unix(from.Unix()/secs*secs, 0)
+	if to.Sub(from)/step > maxPoints {
+		httpjson.Error(w, http.StatusBadRequest, fmt.Errorf("too many steps, at most %d are allowed", maxPoints))
+		return
+	}
+
+	prefix := stats.KindUser + stats.Separator + email + stats.Separator
+	samples, err := a.db.Series(r.Context(), from, to, step, prefix, r.URL.Query().Get("server"))
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	var points []point
+	for t := from; t.Before(to); t = t.Add(step) {
+		points = append(points, point{Time: t})
+	}
+	var total stats.Usage
+	for _, s := range samples {
+		name, ok := stats.ParseName(s.Name)
+		if !ok {
+			continue
+		}
+		i := int(s.Time.Sub(from) / step)
+		if i < 0 || i >= len(points) {
+			continue
+		}
+		p := &points[i]
+		switch name.Direction {
+		case stats.DirectionUplink:
+			p.Uplink += s.Value
+			total.Uplink += s.Value
+		case stats.DirectionDownlink:
+			p.Downlink += s.Value
+			total.Downlink += s.Value
+		}
+		p.Total += s.Value
+	}
+
+	httpjson.Write(w, struct {
+		Email  string        `json:"email"`
+		From   time.Time     `json:"from"`
+		To     time.Time     `json:"to"`
+		Step   int64         `json:"step"`
+		Usage  stats.Traffic `json:"usage"`
+		Points []point       `json:"points"`
+	}{email, from, to, int64(step / time.Second), total.Traffic(), points})
+}
+
+type sysEntry struct {
+	Time   time.Time `json:"time"`
+	Server string    `json:"server"`
+	stats.SysStats
+}
+
+// sys returns the runtime state of the latest scrape of every server, and
+// the runtime state over time.
+func (a *API) sys(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := timeRange(w, r)
+	if !ok {
+		return
+	}
+	pageNum, perPage, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	server := r.URL.Query().Get("server")
+	history, err := a.db.SysSeries(r.Context(), from, to, server)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	latest := []sysEntry{}
+	for _, b := range a.latestBatches(server) {
+		if b.Sys != nil {
+			latest = append(latest, sysEntry{Time: b.Time, Server: b.Server, SysStats: *b.Sys})
+		}
+	}
+	httpjson.Write(w, struct {
+		Latest []sysEntry `json:"latest"`
+		page
+	}{latest, page{
+		From:    from,
+		To:      to,
+		Page:    pageNum,
+		PerPage: perPage,
+		Total:   len(history),
+		Data:    paginate(history, pageNum, perPage),
+	}})
+}
+
+// timeRange parses the from and to parameters, given as RFC 3339 times or
+// dates. to defaults to now and from to 24 hours before to.
+func timeRange(w http.ResponseWriter, r *http.Request) (time.Time, time.Time, bool) {
+	q := r.URL.Query()
+	to := time.Now()
+	if v := q.Get("to"); v != "" {
+		var err error
+		if to, err = parseTime(v); err != nil {
+			httpjson.Error(w, http.StatusBadRequest, err)
+			return to, to, false
+		}
+	}
+	from := to.Add(-24 * time.Hour)
+	if v := q.Get("from"); v != "" {
+		var err error
+		if from, err = parseTime(v); err != nil {
+			httpjson.Error(w, http.StatusBadRequest, err)
+			return from, to, false
+		}
+	}
+	if !from.Before(to) {
+		httpjson.Error(w, http.StatusBadRequest, fmt.Errorf("from must be before to"))
+		return from, to, false
+	}
+	return from, to, true
+}
+
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or YYYY-MM-DD", s)
+}
+
+// pageParams parses the page and per_page parameters.
+func pageParams(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	q := r.URL.Query()
+	pageNum, perPage := 1, defaultPerPage
+	if v := q.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			httpjson.Error(w, http.StatusBadRequest, fmt.Errorf("invalid page %q", v))
+			return 0, 0, false
+		}
+		pageNum = n
+	}
+	if v := q.Get("per_page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPerPage {
+			httpjson.Error(w, http.StatusBadRequest, fmt.Errorf("per_page must be between 1 and %d", maxPerPage))
+			return 0, 0, false
+		}
+		perPage = n
+	}
+	return pageNum, perPage, true
+}
+
+// paginate returns the items on the given page, which is empty past the
+// last page.
+func paginate[T any](items []T, pageNum, perPage int) []T {
+	if pageNum-1 >= (len(items)+perPage-1)/perPage {
+		return []T{}
+	}
+	start := (pageNum - 1) * perPage
+	return items[start:min(start+perPage, len(items))]
+}
+
+func (a *API) fail(w http.ResponseWriter, err error) {
+	a.log.Errorf("Failed to query database: %v", err)
+	httpjson.Error(w, http.StatusInternalServerError, fmt.Errorf("failed to query database"))
+}
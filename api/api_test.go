@@ -0,0 +1,263 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.rikki.moe/v2stat/stats"
+	"go.rikki.moe/v2stat/store"
+)
+
+var base = time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+
+func userStat(email, direction string) string {
+	return stats.KindUser + stats.Separator + email + stats.Separator + "traffic" + stats.Separator + direction
+}
+
+// newTestAPI creates an API accepting the tokens a and b, backed by a
+// database holding the given batches.
+func newTestAPI(t *testing.T, batches ...*stats.Batch) *API {
+	t.Helper()
+	db, err := store.Open(filepath.Join(t.TempDir(), "v2stat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, b := range batches {
+		if err := db.WriteBatch(context.Background(), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return New(db, []string{"a", "b"}, logger)
+}
+
+// get requests path with the given Authorization header and decodes the
+// response into v unless it is nil.
+func get(t *testing.T, a *API, auth, path string, v interface{}) int {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	if v != nil && w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("%s: 401 without WWW-Authenticate", path)
+	}
+	return w.Code
+}
+
+func query(from, to time.Time, params ...string) string {
+	q := url.Values{"from": {from.Format(time.RFC3339)}, "to": {to.Format(time.RFC3339)}}
+	for i := 0; i+1 < len(params); i += 2 {
+		q.Set(params[i], params[i+1])
+	}
+	return "?" + q.Encode()
+}
+
+func TestAuthorization(t *testing.T) {
+	a := newTestAPI(t)
+	tests := []struct {
+		auth string
+		code int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer ", http.StatusUnauthorized},
+		{"Bearer c", http.StatusUnauthorized},
+		{"Bearer ab", http.StatusUnauthorized},
+		{"Basic YTo=", http.StatusUnauthorized},
+		{"bearer a", http.StatusUnauthorized},
+		{"Bearer a", http.StatusOK},
+		{"Bearer b", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := get(t, a, tt.auth, "/users", nil); code != tt.code {
+			t.Errorf("Authorization %q: got %d, want %d", tt.auth, code, tt.code)
+		}
+	}
+
+	// Without tokens, nothing is authorized.
+	open := New(nil, nil, logrus.New())
+	if code := get(t, open, "Bearer ", "/users", nil); code != http.StatusUnauthorized {
+		t.Errorf("empty token without tokens configured: got %d, want 401", code)
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	var batch []stats.Stat
+	for _, email := range []string{"carol@x", "alice@x", "bob@x"} {
+		batch = append(batch, stats.Stat{Name: userStat(email, stats.DirectionUplink), Value: 100})
+	}
+	a := newTestAPI(t, &stats.Batch{Time: base.Add(time.Minute), Server: "s", Stats: batch})
+	if err := a.Write(context.Background(), &stats.Batch{Time: base, Server: "s", Stats: batch[:1]}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		params []string
+		names  []string
+	}{
+		{nil, []string{"alice@x", "bob@x", "carol@x"}},
+		{[]string{"per_page", "2"}, []string{"alice@x", "bob@x"}},
+		{[]string{"per_page", "2", "page", "2"}, []string{"carol@x"}},
+		{[]string{"per_page", "2", "page", "3"}, []string{}},
+		{[]string{"per_page", "1000", "page", "1000000"}, []string{}},
+	}
+	for _, tt := range tests {
+		var p struct {
+			Total int `json:"total"`
+			Data  []struct {
+				Name   string         `json:"name"`
+				Latest *stats.Traffic `json:"latest"`
+				Usage  stats.Traffic  `json:"usage"`
+			} `json:"data"`
+		}
+		path := "/users" + query(base, base.Add(time.Hour), tt.params...)
+		if code := get(t, a, "Bearer a", path, &p); code != http.StatusOK {
+			t.Errorf("%s: got %d", path, code)
+			continue
+		}
+		if p.Data == nil {
+			t.Errorf("%s: data is null, want a list", path)
+		}
+		if p.Total != 3 {
+			t.Errorf("%s: total = %d, want 3", path, p.Total)
+		}
+		var names []string
+		for _, e := range p.Data {
+			names = append(names, e.Name)
+			if e.Usage.Uplink != 100 {
+				t.Errorf("%s: usage of %s = %+v, want 100 up", path, e.Name, e.Usage)
+			}
+			if (e.Latest != nil) != (e.Name == "carol@x") {
+				t.Errorf("%s: latest of %s = %+v", path, e.Name, e.Latest)
+			}
+		}
+		if len(names) != len(tt.names) {
+			t.Errorf("%s: got %v, want %v", path, names, tt.names)
+			continue
+		}
+		for i := range names {
+			if names[i] != tt.names[i] {
+				t.Errorf("%s: got %v, want %v", path, names, tt.names)
+				break
+			}
+		}
+	}
+
+	for _, params := range [][]string{
+		{"page", "0"},
+		{"page", "-1"},
+		{"page", "x"},
+		{"per_page", "0"},
+		{"per_page", "1001"},
+	} {
+		path := "/users" + query(base, base.Add(time.Hour), params...)
+		if code := get(t, a, "Bearer a", path, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", path, code)
+		}
+	}
+}
+
+func TestUsageSteps(t *testing.T) {
+	a := newTestAPI(t,
+		&stats.Batch{Time: base.Add(10 * time.Minute), Server: "s", Stats: []stats.Stat{
+			{Name: userStat("alice@x", stats.DirectionUplink), Value: 100},
+			{Name: userStat("bob@x", stats.DirectionUplink), Value: 1000},
+		}},
+		&stats.Batch{Time: base.Add(70 * time.Minute), Server: "s", Stats: []stats.Stat{
+			{Name: userStat("alice@x", stats.DirectionDownlink), Value: 50},
+		}},
+		&stats.Batch{Time: base.Add(25 * time.Hour), Server: "s", Stats: []stats.Stat{
+			{Name: userStat("alice@x", stats.DirectionUplink), Value: 7},
+		}},
+	)
+
+	tests := []struct {
+		from, to time.Time
+		step     string
+		// start is the aligned start of the first step.
+		start  time.Time
+		totals []int64
+	}{
+		{base.Add(30 * time.Minute), base.Add(3 * time.Hour), "1h", base, []int64{100, 50, 0}},
+		{base.Add(5 * time.Hour), base.Add(48 * time.Hour), "1d", base, []int64{150, 7}},
+		{base.Add(20 * time.Minute), base.Add(80 * time.Minute), "30m", base, []int64{100, 0, 50}},
+	}
+	for _, tt := range tests {
+		var resp struct {
+			From   time.Time     `json:"from"`
+			Step   int64         `json:"step"`
+			Usage  stats.Traffic `json:"usage"`
+			Points []point       `json:"points"`
+		}
+		path := "/users/alice@x/usage" + query(tt.from, tt.to, "step", tt.step)
+		if code := get(t, a, "Bearer a", path, &resp); code != http.StatusOK {
+			t.Errorf("%s: got %d", path, code)
+			continue
+		}
+		if !resp.From.Equal(tt.start) {
+			t.Errorf("%s: from = %s, want %s", path, resp.From, tt.start)
+		}
+		var sum int64
+		var totals []int64
+		for i, p := range resp.Points {
+			if want := tt.start.Add(time.Duration(i) * time.Duration(resp.Step) * time.Second); !p.Time.Equal(want) {
+				t.Errorf("%s: point %d at %s, want %s", path, i, p.Time, want)
+			}
+			totals = append(totals, p.Total)
+			sum += p.Total
+		}
+		if len(totals) != len(tt.totals) {
+			t.Errorf("%s: got totals %v, want %v", path, totals, tt.totals)
+			continue
+		}
+		for i := range totals {
+			if totals[i] != tt.totals[i] {
+				t.Errorf("%s: got totals %v, want %v", path, totals, tt.totals)
+				break
+			}
+		}
+		if resp.Usage.Total != sum {
+			t.Errorf("%s: usage %d, want the sum of the points %d", path, resp.Usage.Total, sum)
+		}
+	}
+}
+
+func TestUsageRejects(t *testing.T) {
+	a := newTestAPI(t)
+	for _, q := range []string{
+		query(base, base.Add(3*time.Hour), "step", "1s"),
+		query(base, base.Add(3*time.Hour), "step", "500ms"),
+		query(base, base.Add(3*time.Hour), "step", "x"),
+		query(base.Add(time.Hour), base),
+		"?from=yesterday",
+	} {
+		path := "/users/alice@x/usage" + q
+		if code := get(t, a, "Bearer a", path, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", path, code)
+		}
+	}
+
+	// maxPoints steps are still allowed.
+	path := "/users/alice@x/usage" + query(base, base.Add(maxPoints*time.Second), "step", "1s")
+	if code := get(t, a, "Bearer a", path, nil); code != http.StatusOK {
+		t.Errorf("%s: got %d, want 200", path, code)
+	}
+}
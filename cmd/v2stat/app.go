@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"go.rikki.moe/v2stat/alert"
+	"go.rikki.moe/v2stat/config"
+	"go.rikki.moe/v2stat/health"
+	"go.rikki.moe/v2stat/sink"
+	"go.rikki.moe/v2stat/store"
+)
+
+// app runs a collector per target, writing to a set of sinks. Its
+// configuration can be replaced while it runs.
+type app struct {
+	cfg   *config.Config
+	sinks *sink.Multi
+	// monitor and sd are told about the collectors if set.
+	monitor *health.Monitor
+	sd      *notifier
+	// alerts holds the alerting engine, nil if alerting is disabled. The
+	// collectors share it, so it can be replaced while they run.
+	alerts atomic.Pointer[alert.Engine]
+
+	running map[string]*running
+}
+
+// running is a collector running in the background.
+type running struct {
+	target config.Target
+	c      *collector
+	conn   *grpc.ClientConn
+	// cancel stops collecting, abort cancels the calls and writes in
+	// progress.
+	cancel context.CancelFunc
+	abort  context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// stop stops the collector after its final scrape, aborting whatever is left
+// to do by deadline.
+func (r *running) stop(deadline time.Time) {
+	timer := time.AfterFunc(time.Until(deadline), r.abort)
+	r.cancel()
+	r.wg.Wait()
+	timer.Stop()
+	r.abort()
+	r.conn.Close()
+}
+
+// openSinks sets up the sinks of cfg that can be reloaded.
+func (a *app) openSinks(cfg *config.Config) error {
+	if cfg.InfluxDB.URL != "" {
+		if err := a.replaceSink("influxdb", a.influxOpener(cfg.InfluxDB)); err != nil {
+			return fmt.Errorf("influxdb: %w", err)
+		}
+	}
+	if cfg.SQLite.Path != "" {
+		if err := a.replaceSink("sqlite", sqliteOpener(cfg.SQLite)); err != nil {
+			return fmt.Errorf("sqlite: %w", err)
+		}
+	}
+	if cfg.Quota.State != "" {
+		if err := a.replaceSink("quota", quotaOpener(cfg.Quota)); err != nil {
+			return fmt.Errorf("quota: %w", err)
+		}
+	}
+	return nil
+}
+
+// replaceSink replaces the sink of the given name with the one returned by
+// open, or removes it if open is nil, keeping it if open fails.
+func (a *app) replaceSink(name string, open func() (sink.Sink, error)) error {
+	old, err := a.sinks.Replace(name, open)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		if err := old.Close(); err != nil {
+			logger.Errorf("Failed to close %s sink: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// influxOpener returns a function opening the InfluxDB sink, or nil if it
+// is disabled.
+func (a *app) influxOpener(ic config.InfluxDB) func() (sink.Sink, error) {
+	if ic.URL == "" {
+		return nil
+	}
+	return func() (sink.Sink, error) {
+		var influx sink.Sink = sink.NewInflux(ic.URL, ic.Token, ic.Org, ic.Bucket)
+		if ic.Spool == "" {
+			return influx, nil
+		}
+		// A spool opened on reload may drain the directory of the current
+		// one until that is closed. A batch written twice overwrites the
+		// same points in InfluxDB.
+		spool, err := sink.NewSpool(ic.Spool, ic.SpoolMax, influx, logger)
+		if err != nil {
+			return nil, fmt.Errorf("open spool: %w", err)
+		}
+		if a.monitor != nil {
+			a.monitor.SetSpool(spool)
+		}
+		return spool, nil
+	}
+}
+
+// sqliteOpener returns a function opening the SQLite sink, or nil if it is
+// disabled.
+func sqliteOpener(sc config.SQLite) func() (sink.Sink, error) {
+	if sc.Path == "" {
+		return nil
+	}
+	return func() (sink.Sink, error) {
+		return sink.NewSQLite(sc.Path, retention(sc.Retention), logger)
+	}
+}
+
+// retention converts the retention configuration.
+func retention(r config.Retention) store.Retention {
+	return store.Retention{
+		Raw:     time.Duration(r.Raw),
+		Hourly:  time.Duration(r.Hourly),
+		Daily:   time.Duration(r.Daily),
+		Monthly: time.Duration(r.Monthly),
+	}
+}
+
+// quotaOpener returns a function setting up quotas, or nil if they are
+// disabled.
+func quotaOpener(qc config.Quota) func() (sink.Sink, error) {
+	if qc.State == "" {
+		return nil
+	}
+	return func() (sink.Sink, error) {
+		return newQuota(qc)
+	}
+}
+
+// prepare sets up collectors for the targets of cfg that are not collected
+// from yet or whose settings changed, or for all targets if restartAll is
+// set, without starting them. Nothing is set up if any target fails.
+func (a *app) prepare(cfg *config.Config, restartAll bool) (map[string]*running, error) {
+	fresh := make(map[string]*running)
+	for _, t := range cfg.Targets {
+		if r, ok := a.running[t.Name]; ok && !restartAll && reflect.DeepEqual(t, r.target) {
+			continue
+		}
+		c, conn, err := newCollector(cfg, t, a.sinks)
+		if err != nil {
+			for _, r := range fresh {
+				r.conn.Close()
+			}
+			return nil, fmt.Errorf("target %s: %w", t.Name, err)
+		}
+		fresh[t.Name] = &running{target: t, c: c, conn: conn}
+	}
+	return fresh, nil
+}
+
+// start starts the prepared collectors.
+func (a *app) start(fresh map[string]*running) {
+	for name, r := range fresh {
+		c, conn := r.c, r.conn
+		c.alerts = &a.alerts
+		if a.monitor != nil {
+			a.monitor.AddTarget(c.name, c.interval)
+			c.health = a.monitor
+		}
+		if a.sd != nil {
+			a.sd.add(c)
+		}
+
+		if c.align {
+			c.log.Infof("Collecting stats from %s every %s, %s past the boundary", r.target.Address, c.interval, c.delay)
+		} else {
+			c.log.Infof("Collecting stats from %s every %s", r.target.Address, c.interval)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		hard, abort := context.WithCancel(context.Background())
+		r.cancel, r.abort = cancel, abort
+		r.wg.Add(2)
+		go func() {
+			defer r.wg.Done()
+			c.run(ctx, hard)
+		}()
+		var ready func()
+		if a.sd != nil {
+			ready = func() { a.sd.connected(c) }
+		}
+		go func() {
+			defer r.wg.Done()
+			watchState(ctx, conn, c.log, ready)
+		}()
+		a.running[name] = r
+	}
+}
+
+// stopTarget stops collecting stats from the target of the given name.
+func (a *app) stopTarget(name string) {
+	r := a.running[name]
+	r.stop(time.Now().Add(r.c.shutdownTimeout))
+	if a.sd != nil {
+		a.sd.remove(r.c)
+	}
+	delete(a.running, name)
+}
+
+// stop stops all collectors, each scraping its target a final time, and
+// flushes the sinks, all within the shutdown timeout.
+func (a *app) stop() {
+	deadline := time.Now().Add(time.Duration(a.cfg.ShutdownTimeout))
+	var wg sync.WaitGroup
+	for _, r := range a.running {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.stop(deadline)
+		}()
+	}
+	wg.Wait()
+	for _, r := range a.running {
+		for name := range r.c.missed {
+			r.c.log.Warnf("Traffic the %s sink failed to write is lost", name)
+		}
+	}
+
+	// Write out stats still buffered, e.g. in the spool.
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := a.sinks.Flush(ctx); err != nil {
+		logger.Errorf("Failed to flush sinks: %v", err)
+	}
+}
+
+// reload applies the configuration as it is now, keeping the current one if
+// it is invalid. Sinks and collectors are only replaced if their settings
+// changed, so the accumulated and buffered stats of the others are kept.
+// The HTTP server cannot be reconfigured.
+func (a *app) reload() {
+	cfg, err := loadConfig()
+	if err != nil {
+		logger.Errorf("Invalid configuration, keeping the current one: %v", err)
+		return
+	}
+	old := a.cfg
+	if cfg.Listen != old.Listen || cfg.Dashboard != old.Dashboard || cfg.DashboardAuth != old.DashboardAuth ||
+		!reflect.DeepEqual(cfg.HTTPAPI, old.HTTPAPI) {
+		logger.Warn("Changes to listen, dashboard, dashboard_auth and http_api take effect after a restart")
+		cfg.Listen, cfg.Dashboard, cfg.DashboardAuth, cfg.HTTPAPI = old.Listen, old.Dashboard, old.DashboardAuth, old.HTTPAPI
+	}
+	if (cfg.Dashboard || cfg.HTTPAPI.Enabled) && cfg.SQLite.Path != old.SQLite.Path {
+		logger.Warn("Changes to the sqlite path take effect after a restart while the dashboard or HTTP API is enabled")
+		cfg.SQLite.Path = old.SQLite.Path
+	}
+	if !hasSinks(cfg) {
+		logger.Errorf("Invalid configuration, keeping the current one: no storage configured")
+		return
+	}
+
+	// Collectors are set up before any is stopped, so a target that cannot
+	// be set up leaves the current ones running.
+	restartAll := !reflect.DeepEqual(collectorSettings(cfg), collectorSettings(old))
+	fresh, err := a.prepare(cfg, restartAll)
+	if err != nil {
+		logger.Errorf("Invalid configuration, keeping the current one: %v", err)
+		return
+	}
+
+	if err := configureLogger(logger, cfg.LogLevel, cfg.LogFormat); err != nil {
+		logger.Errorf("Failed to configure logging: %v", err)
+	}
+
+	// Collectors write to the sinks while they are replaced. Sinks failing
+	// to open keep their current settings, so reloading again retries them.
+	if !reflect.DeepEqual(cfg.InfluxDB, old.InfluxDB) {
+		if err := a.replaceSink("influxdb", a.influxOpener(cfg.InfluxDB)); err != nil {
+			logger.Errorf("Failed to reload InfluxDB sink, keeping the current one: %v", err)
+			cfg.InfluxDB = old.InfluxDB
+		} else if cfg.InfluxDB.Spool == "" && a.monitor != nil {
+			a.monitor.SetSpool(nil)
+		}
+	}
+	if s, ok := a.sinks.Get("sqlite").(*sink.SQLite); ok && cfg.SQLite.Path == old.SQLite.Path {
+		// The database stays open, e.g. for the dashboard.
+		s.SetRetention(retention(cfg.SQLite.Retention))
+	} else if cfg.SQLite != old.SQLite {
+		if err := a.replaceSink("sqlite", sqliteOpener(cfg.SQLite)); err != nil {
+			logger.Errorf("Failed to reload SQLite sink, keeping the current one: %v", err)
+			cfg.SQLite = old.SQLite
+		}
+	}
+	if !reflect.DeepEqual(cfg.Quota, old.Quota) {
+		if err := a.replaceSink("quota", quotaOpener(cfg.Quota)); err != nil {
+			logger.Errorf("Failed to reload quotas, keeping the current ones: %v", err)
+			cfg.Quota = old.Quota
+		}
+	}
+
+	// Replaced collectors scrape their target a final time when stopped.
+	// Their successors take over the counter state and the traffic sinks
+	// missed, which are only final once they stopped.
+	targets := make(map[string]bool, len(cfg.Targets))
+	for _, t := range cfg.Targets {
+		targets[t.Name] = true
+	}
+	for name, r := range a.running {
+		next, replaced := fresh[name]
+		if targets[name] && !replaced {
+			continue
+		}
+		a.stopTarget(name)
+		if replaced {
+			if next.target.State == r.target.State {
+				next.c.tracker = r.c.tracker
+			}
+			next.c.missed = r.c.missed
+		} else if a.monitor != nil {
+			a.monitor.RemoveTarget(name)
+		}
+	}
+	// Running collectors switch to the new alerting engine with their next
+	// scrape. The old one ignores scrapes once it is closed.
+	if !reflect.DeepEqual(cfg.Alerts, old.Alerts) {
+		var engine *alert.Engine
+		if len(cfg.Alerts.Rules) > 0 {
+			engine = newAlertEngine(cfg.Alerts)
+		}
+		if prev := a.alerts.Swap(engine); prev != nil {
+			prev.Close()
+		}
+	}
+
+	a.cfg = cfg
+	a.start(fresh)
+	logger.Info("Reloaded configuration")
+}
+
+// collectorSettings returns the global settings the collectors depend on.
+func collectorSettings(cfg *config.Config) []interface{} {
+	return []interface{}{
+		cfg.Filter, cfg.Align, cfg.Offset, cfg.Jitter,
+		cfg.Timeout, cfg.Retries, cfg.Keepalive, cfg.ShutdownTimeout,
+	}
+}
+
+// hasSinks reports whether the configuration has anywhere to write stats to.
+func hasSinks(cfg *config.Config) bool {
+	return cfg.InfluxDB.URL != "" || cfg.SQLite.Path != "" || cfg.Listen != "" || cfg.Quota.State != ""
+}
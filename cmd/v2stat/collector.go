@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go.rikki.moe/v2stat/alert"
+	"go.rikki.moe/v2stat/command"
+	"go.rikki.moe/v2stat/health"
+	"go.rikki.moe/v2stat/sink"
+	"go.rikki.moe/v2stat/stats"
+)
+
+// collector scrapes a V2Ray server and writes its stats to a sink.
+type collector struct {
+	name     string
+	client   command.StatsServiceClient
+	sink     *sink.Multi
+	interval time.Duration
+	// align schedules scrapes on multiples of interval, delayed by delay.
+	align bool
+	delay time.Duration
+	// shutdownTimeout bounds every write to the sinks, and everything left
+	// to do once collection stops.
+	shutdownTimeout time.Duration
+	// timeout bounds every call to the API.
+	timeout time.Duration
+	// retries is the number of times a failed scrape is retried.
+	retries int
+	// filters all have to select a stat for it to be collected.
+	filters []*stats.Filter
+	log     logrus.FieldLogger
+	// socket is the path of the API socket if it is a Unix socket.
+	socket string
+	// alerts holds the engine notified about every scrape if alerting is
+	// enabled. It is shared by all collectors and replaced on reload.
+	alerts *atomic.Pointer[alert.Engine]
+	// health is told about every scrape and write if set.
+	health *health.Monitor
+	// systemd is told about every scrape if set.
+	systemd *notifier
+	// busySince is the time in Unix nanoseconds the running collect started
+	// at, 0 if none is running.
+	busySince atomic.Int64
+
+	// tracker is set in non-destructive mode, where counters are queried
+	// without reset and deltas are computed locally.
+	tracker *stats.Tracker
+	// pending is the snapshot to commit to tracker once the batch computed
+	// from it is written.
+	pending *stats.Counters
+	// missed holds, by sink, the traffic of batches the sink failed to
+	// write. It is added to the next batch written to the sink, so the
+	// other sinks do not have to count it again.
+	missed map[string]map[string]int64
+
+	// lastUptime is the V2Ray uptime seen in the previous scrape.
+	lastUptime uint32
+}
+
+// run collects stats every interval until ctx is canceled, then collects
+// them one last time. Scrapes and writes in progress, including the final
+// ones, are only aborted once hard is canceled.
+func (c *collector) run(ctx, hard context.Context) {
+	defer c.final(hard)
+	if c.align {
+		c.runAligned(ctx, hard)
+		return
+	}
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.collect(ctx, hard, time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runAligned collects stats delay after every multiple of interval since
+// the Unix epoch until ctx is canceled. Batches are stamped with the
+// boundary rather than the time of the scrape.
+func (c *collector) runAligned(ctx, hard context.Context) {
+	for {
+		next := nextBoundary(time.Now().Add(-c.delay), c.interval)
+		timer := time.NewTimer(time.Until(next.Add(c.delay)))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		c.collect(ctx, hard, next)
+	}
+}
+
+// final scrapes the server once more when collection stops, so traffic
+// since the previous scrape is not lost on restarts. The scrape and the write
+// are aborted once hard is canceled.
+func (c *collector) final(hard context.Context) {
+	c.log.Info("Collecting final stats")
+	c.collect(hard, hard, time.Now())
+}
+
+// nextBoundary returns the first multiple of interval since the Unix epoch
+// after t.
+func nextBoundary(t time.Time, interval time.Duration) time.Time {
+	n := int64(interval)
+	return time.Unix(0, (t.UnixNano()/n+1)*n)
+}
+
+// collect scrapes the server once and writes the result stamped with now.
+// Retries stop once ctx is canceled, the calls and the write once hard is.
+func (c *collector) collect(ctx, hard context.Context, now time.Time) {
+	c.busySince.Store(time.Now().UnixNano())
+	defer c.busySince.Store(0)
+
+	batch, err := c.scrapeRetry(ctx, hard, now)
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) && hard.Err() == nil {
+		// Shutting down, the final scrape follows.
+		return
+	}
+	if c.alerts != nil {
+		if e := c.alerts.Load(); e != nil {
+			e.Observe(c.name, now, batch, err)
+		}
+	}
+	if c.systemd != nil {
+		c.systemd.scraped(c, now, batch, err)
+	}
+	if err != nil {
+		// gRPC errors of Unix sockets tend to be cryptic.
+		if c.socket != "" {
+			if serr := checkSocket(c.socket); serr != nil {
+				err = serr
+			}
+		}
+		c.log.Errorf("Failed to get stats: %v", err)
+		return
+	}
+	// The counters are reset already, so the write is completed even if
+	// collection stops in the meantime.
+	wctx, cancel := context.WithTimeout(hard, c.shutdownTimeout)
+	written, err := c.write(wctx, batch)
+	cancel()
+	if c.health != nil {
+		c.health.ObserveWrite(c.name, err)
+	}
+	if err != nil {
+		c.log.Errorf("Failed to write stats: %v", err)
+	}
+	if c.tracker != nil && written {
+		if err := c.tracker.Commit(c.pending); err != nil {
+			c.log.Errorf("Failed to save counter state: %v", err)
+		}
+	}
+}
+
+// write writes the batch to every sink, along with the traffic the sink
+// missed before, and reports whether any sink wrote it. In non-destructive
+// mode, a batch no sink wrote is not recorded as missed, since the next delta
+// includes its traffic.
+func (c *collector) write(ctx context.Context, batch *stats.Batch) (bool, error) {
+	sent := make(map[string]*stats.Batch)
+	failed := make(map[string]bool)
+	var written bool
+	err := c.sink.WriteEach(ctx, func(name string) *stats.Batch {
+		b := withMissed(batch, c.missed[name])
+		sent[name] = b
+		return b
+	}, func(name string, err error) {
+		failed[name] = err != nil
+		written = written || err == nil
+	})
+	if !written && c.tracker != nil {
+		return false, err
+	}
+	for name, b := range sent {
+		if !failed[name] {
+			delete(c.missed, name)
+			continue
+		}
+		if c.missed == nil {
+			c.missed = make(map[string]map[string]int64)
+		}
+		missed := make(map[string]int64, len(b.Stats))
+		for _, s := range b.Stats {
+			missed[s.Name] = s.Value
+		}
+		c.missed[name] = missed
+	}
+	return written, err
+}
+
+// withMissed returns the batch with the missed traffic added to it.
+func withMissed(batch *stats.Batch, missed map[string]int64) *stats.Batch {
+	if len(missed) == 0 {
+		return batch
+	}
+	b := *batch
+	b.Stats = make([]stats.Stat, 0, len(batch.Stats)+len(missed))
+	seen := make(map[string]bool, len(batch.Stats))
+	for _, s := range batch.Stats {
+		s.Value += missed[s.Name]
+		seen[s.Name] = true
+		b.Stats = append(b.Stats, s)
+	}
+	for name, value := range missed {
+		if !seen[name] {
+			b.Stats = append(b.Stats, stats.Stat{Name: name, Value: value})
+		}
+	}
+	return &b
+}
+
+// request builds the QueryStats request. V2Ray can only match a single set
+// of include patterns, so the last filter having any is passed to it; all
+// filters are still applied to the response.
+func (c *collector) request() *command.QueryStatsRequest {
+	req := &command.QueryStatsRequest{
+		Reset_: c.tracker == nil,
+	}
+	for i := len(c.filters) - 1; i >= 0; i-- {
+		if f := c.filters[i]; len(f.Include) > 0 {
+			req.Patterns = f.Include
+			req.Regexp = f.Regexp
+			break
+		}
+	}
+	return req
+}
+
+// stuck reports whether a collect has been running for longer than it
+// should: retries are bounded by the interval, leaving the two calls of the
+// last attempt, each bounded by timeout, and the write to sinks, bounded by
+// shutdownTimeout.
+func (c *collector) stuck(now time.Time) bool {
+	since := c.busySince.Load()
+	return since != 0 && now.Sub(time.Unix(0, since)) > c.interval+2*c.timeout+c.shutdownTimeout
+}
+
+// scrapeRetry scrapes the server, retrying transient failures up to retries
+// times with exponential backoff as long as the retries fit into the interval.
+// Timeouts are not retried when counters are reset by the query.
+func (c *collector) scrapeRetry(ctx, hard context.Context, now time.Time) (*stats.Batch, error) {
+	deadline := time.Now().Add(c.interval)
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		batch, err := c.scrape(hard, now)
+		if c.health != nil && ctx.Err() == nil {
+			c.health.ObserveScrape(c.name, time.Since(start), err)
+		}
+		if err != nil && c.tracker == nil && status.Code(err) == codes.DeadlineExceeded {
+			// V2Ray may have reset the counters before the response was
+			// lost, a retry would only see the traffic since then.
+			c.log.Warnf("Query timed out, traffic since the previous scrape is likely lost")
+			return batch, err
+		}
+		if err == nil || attempt == c.retries || !retryable(err) || time.Now().Add(backoff).After(deadline) {
+			return batch, err
+		}
+		c.log.Warnf("Failed to get stats, retrying in %s: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// retryable reports whether a failed call may succeed when retried.
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// scrape queries the traffic of the V2Ray server since the previous scrape,
+// along with its runtime state, stamped with now. Counters are reset by the
+// query unless the collector is in non-destructive mode. V2Ray may reset the
+// counters even if the call is canceled, so ctx should only be canceled when
+// there is no time left to complete it.
+func (c *collector) scrape(ctx context.Context, now time.Time) (*stats.Batch, error) {
+	callCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	resp, err := c.client.QueryStats(callCtx, c.request())
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	batch := stats.NewBatch(now, c.name, resp.Stat)
+	for _, f := range c.filters {
+		batch.Stats = f.Apply(batch.Stats)
+	}
+
+	callCtx, cancel = context.WithTimeout(ctx, c.timeout)
+	sys, err := c.client.GetSysStats(callCtx, &command.SysStatsRequest{})
+	cancel()
+	// The tracker compares the uptime against the time passed between
+	// snapshots, so they are stamped with when the scrape actually ran
+	// rather than with now, which may be an aligned boundary.
+	scraped := time.Now()
+	if err != nil {
+		c.log.Warnf("Failed to get sys stats: %v", err)
+	} else {
+		batch.Sys = stats.NewSysStats(sys)
+	}
+
+	var restarted bool
+	if c.tracker != nil {
+		cur := &stats.Counters{Time: scraped, Values: make(map[string]int64, len(batch.Stats))}
+		for _, s := range batch.Stats {
+			cur.Values[s.Name] = s.Value
+		}
+		if batch.Sys != nil {
+			cur.Uptime = batch.Sys.Uptime
+		}
+		batch.Stats, c.pending, restarted = c.tracker.Delta(cur)
+	} else if batch.Sys != nil {
+		// Uptime going backwards means V2Ray was restarted since the last
+		// scrape.
+		restarted = batch.Sys.Uptime < c.lastUptime
+	}
+	if batch.Sys != nil {
+		if restarted {
+			c.log.Warnf("V2Ray restart detected, uptime is %ds", batch.Sys.Uptime)
+			batch.Sys.Restarted = true
+		}
+		c.lastUptime = batch.Sys.Uptime
+	}
+	return batch, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go.rikki.moe/v2stat/command"
+	"go.rikki.moe/v2stat/sink"
+	"go.rikki.moe/v2stat/stats"
+)
+
+const testStat = "user>>>alice@x>>>traffic>>>uplink"
+
+// fakeClient serves a counter growing by 100 bytes per query, never reset,
+// of a V2Ray started 30 seconds before the first query. Queries fail with
+// the errors in errs first.
+type fakeClient struct {
+	command.StatsServiceClient
+	queries int
+	errs    []error
+	calls   int
+}
+
+func (f *fakeClient) QueryStats(ctx context.Context, in *command.QueryStatsRequest, opts ...grpc.CallOption) (*command.QueryStatsResponse, error) {
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+	f.queries++
+	return &command.QueryStatsResponse{Stat: []*command.Stat{{Name: testStat, Value: int64(100 * f.queries)}}}, nil
+}
+
+func (f *fakeClient) GetSysStats(ctx context.Context, in *command.SysStatsRequest, opts ...grpc.CallOption) (*command.SysStatsResponse, error) {
+	return &command.SysStatsResponse{Uptime: uint32(60*f.queries - 30)}, nil
+}
+
+// countingSink sums the traffic written to it, failing while fail is set.
+type countingSink struct {
+	total int64
+	fail  bool
+}
+
+func (s *countingSink) Write(ctx context.Context, b *stats.Batch) error {
+	if s.fail {
+		return errors.New("unavailable")
+	}
+	for _, st := range b.Stats {
+		s.total += st.Value
+	}
+	return nil
+}
+
+func (s *countingSink) Flush(ctx context.Context) error { return nil }
+func (s *countingSink) Close() error                    { return nil }
+
+func newTestCollector(t *testing.T, sinks *sink.Multi) *collector {
+	t.Helper()
+	tracker, err := stats.LoadTracker(filepath.Join(t.TempDir(), "state.json"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &collector{
+		name:     "test",
+		client:   &fakeClient{},
+		sink:     sinks,
+		interval: time.Minute,
+		timeout:  time.Second,
+		log:      logrus.New(),
+		tracker:  tracker,
+	}
+}
+
+func TestCollectFailingSinkDoesNotRecountOthers(t *testing.T) {
+	good, flaky := &countingSink{}, &countingSink{}
+	sinks := &sink.Multi{}
+	sinks.Add("good", good)
+	sinks.Add("flaky", flaky)
+	c := newTestCollector(t, sinks)
+
+	start := time.Unix(1_700_000_000, 0)
+	for i := 0; i < 5; i++ {
+		flaky.fail = i == 1 || i == 2
+		c.collect(context.Background(), context.Background(), start.Add(time.Duration(i)*time.Minute))
+	}
+	if good.total != 500 {
+		t.Errorf("good sink got %d bytes, want 500", good.total)
+	}
+	if flaky.total != 500 {
+		t.Errorf("flaky sink got %d bytes, want 500", flaky.total)
+	}
+	if len(c.missed) != 0 {
+		t.Errorf("missed traffic left after recovery: %v", c.missed)
+	}
+}
+
+func TestCollectAllSinksFailing(t *testing.T) {
+	a, b := &countingSink{}, &countingSink{}
+	sinks := &sink.Multi{}
+	sinks.Add("a", a)
+	sinks.Add("b", b)
+	c := newTestCollector(t, sinks)
+
+	start := time.Unix(1_700_000_000, 0)
+	for i := 0; i < 4; i++ {
+		a.fail = i == 1 || i == 2
+		b.fail = i == 1
+		c.collect(context.Background(), context.Background(), start.Add(time.Duration(i)*time.Minute))
+	}
+	if a.total != 400 || b.total != 400 {
+		t.Errorf("sinks got %d and %d bytes, want 400 each", a.total, b.total)
+	}
+}
+
+func TestCollectAlignedThenFinalIsNotRestart(t *testing.T) {
+	total := &countingSink{}
+	sinks := &sink.Multi{}
+	sinks.Add("total", total)
+	c := newTestCollector(t, sinks)
+
+	// An aligned scrape is stamped with a boundary long before it ran, the
+	// final scrape on shutdown with the current time.
+	c.collect(context.Background(), context.Background(), time.Now().Add(-10*time.Minute))
+	c.collect(context.Background(), context.Background(), time.Now())
+	if total.total != 200 {
+		t.Errorf("sink got %d bytes, want 200", total.total)
+	}
+}
+
+func TestStuck(t *testing.T) {
+	c := &collector{interval: time.Minute, timeout: 10 * time.Second, shutdownTimeout: time.Minute}
+	start := time.Unix(1_700_000_000, 0)
+	if c.stuck(start.Add(time.Hour)) {
+		t.Error("idle collector is stuck")
+	}
+	c.busySince.Store(start.UnixNano())
+	// A slow write after the last attempt is still within bounds.
+	if c.stuck(start.Add(2*time.Minute + 20*time.Second)) {
+		t.Error("collector stuck within interval, calls and write")
+	}
+	if !c.stuck(start.Add(2*time.Minute + 21*time.Second)) {
+		t.Error("collector not stuck past interval, calls and write")
+	}
+}
+
+func TestScrapeRetry(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	timeout := status.Error(codes.DeadlineExceeded, "deadline exceeded")
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name     string
+		errs     []error
+		reset    bool
+		interval time.Duration
+		ctx      context.Context
+		calls    int
+		ok       bool
+	}{
+		{"success", nil, false, time.Minute, context.Background(), 1, true},
+		{"retried", []error{unavailable}, false, time.Minute, context.Background(), 2, true},
+		{"timeout without reset", []error{timeout}, false, time.Minute, context.Background(), 2, true},
+		{"timeout with reset", []error{timeout}, true, time.Minute, context.Background(), 1, false},
+		{"not retryable", []error{status.Error(codes.PermissionDenied, "denied")}, false, time.Minute, context.Background(), 1, false},
+		{"plain error", []error{errors.New("broken")}, false, time.Minute, context.Background(), 1, false},
+		{"backoff exceeds interval", []error{unavailable}, false, 500 * time.Millisecond, context.Background(), 1, false},
+		{"retries exhausted", []error{unavailable, unavailable}, false, time.Minute, context.Background(), 2, false},
+		{"canceled", []error{unavailable}, false, time.Minute, canceled, 1, false},
+	}
+	for _, tt := range tests {
+		c := newTestCollector(t, &sink.Multi{})
+		client := &fakeClient{errs: tt.errs}
+		c.client, c.interval, c.retries = client, tt.interval, 1
+		if tt.reset {
+			c.tracker = nil
+		}
+		start := time.Now()
+		_, err := c.scrapeRetry(tt.ctx, context.Background(), start)
+		if (err == nil) != tt.ok || client.calls != tt.calls {
+			t.Errorf("%s: got error %v after %d calls, want ok %v after %d", tt.name, err, client.calls, tt.ok, tt.calls)
+		}
+		if elapsed := time.Since(start); elapsed > tt.interval {
+			t.Errorf("%s: took %s, longer than the interval", tt.name, elapsed)
+		}
+	}
+}
+
+func TestRequestPatterns(t *testing.T) {
+	filter := func(include []string, isRegexp bool) *stats.Filter {
+		f, err := stats.NewFilter(include, nil, isRegexp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	tests := []struct {
+		name     string
+		filters  []*stats.Filter
+		patterns []string
+		regexp   bool
+	}{
+		{"none", []*stats.Filter{filter(nil, false), filter(nil, false)}, nil, false},
+		{"global", []*stats.Filter{filter([]string{"user>>>"}, false), filter(nil, false)}, []string{"user>>>"}, false},
+		{"target", []*stats.Filter{filter([]string{"user>>>"}, false), filter([]string{"^user>>>a"}, true)}, []string{"^user>>>a"}, true},
+	}
+	for _, tt := range tests {
+		c := &collector{filters: tt.filters}
+		req := c.request()
+		if !slices.Equal(req.Patterns, tt.patterns) || req.Regexp != tt.regexp {
+			t.Errorf("%s: patterns %q, regexp %v, want %q, %v", tt.name, req.Patterns, req.Regexp, tt.patterns, tt.regexp)
+		}
+		if !req.Reset_ {
+			t.Errorf("%s: counters not reset without a tracker", tt.name)
+		}
+	}
+
+	// The includes of the global filter are not sent to V2Ray if the target
+	// has its own, but still applied to the response.
+	c := newTestCollector(t, &sink.Multi{})
+	c.filters = []*stats.Filter{filter([]string{"bob@x"}, false), filter([]string{"user>>>"}, false)}
+	if req := c.request(); req.Reset_ || !slices.Equal(req.Patterns, []string{"user>>>"}) {
+		t.Errorf("got %+v, want user>>> without reset in non-destructive mode", req)
+	}
+	batch, err := c.scrape(context.Background(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Stats) != 0 {
+		t.Errorf("got %+v, want %s filtered out", batch.Stats, testStat)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.rikki.moe/v2stat/config"
+)
+
+// loadConfig assembles the configuration. Settings are taken from, in
+// increasing order of precedence: defaults, the configuration file,
+// environment variables and explicitly set flags.
+func loadConfig() (*config.Config, error) {
+	cfg := config.Default()
+	if *flagConfig != "" {
+		if err := cfg.Load(*flagConfig); err != nil {
+			return nil, err
+		}
+	}
+	cfg.ApplyEnv()
+
+	flagTarget := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "interval":
+			cfg.Interval = *flagInterval
+		case "align":
+			cfg.Align = *flagAlign
+		case "offset":
+			cfg.Offset = config.Duration(*flagOffset)
+		case "jitter":
+			cfg.Jitter = config.Duration(*flagJitter)
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = config.Duration(*flagShutdown)
+		case "timeout":
+			cfg.Timeout = config.Duration(*flagTimeout)
+		case "retries":
+			cfg.Retries = *flagRetries
+		case "keepalive":
+			cfg.Keepalive = config.Duration(*flagKeepalive)
+		case "influx":
+			cfg.InfluxDB.URL = *flagInflux
+		case "token":
+			cfg.InfluxDB.Token = *flagInfluxToken
+		case "org":
+			cfg.InfluxDB.Org = *flagOrg
+		case "bucket":
+			cfg.InfluxDB.Bucket = *flagBucket
+		case "spool":
+			cfg.InfluxDB.Spool = *flagSpool
+		case "spool-max":
+			cfg.InfluxDB.SpoolMax = *flagSpoolMax
+		case "db":
+			cfg.SQLite.Path = *flagDB
+		case "listen":
+			cfg.Listen = *flagListen
+		case "dashboard":
+			cfg.Dashboard = *flagDashboard
+		case "dashboard-password-file":
+			cfg.DashboardAuth.PasswordFile = *flagDashPassword
+		case "http-api":
+			cfg.HTTPAPI.Enabled = *flagHTTPAPI
+		case "http-api-token-file":
+			cfg.HTTPAPI.TokenFile = *flagHTTPAPITokens
+		case "include":
+			cfg.Filter.Include = splitList(*flagInclude)
+		case "exclude":
+			cfg.Filter.Exclude = splitList(*flagExclude)
+		case "regexp":
+			cfg.Filter.Regexp = *flagRegexp
+		case "log-level":
+			cfg.LogLevel = *flagLogLevel
+		case "log-format":
+			cfg.LogFormat = *flagLogFormat
+		case "server", "name", "state", "tls", "tls-ca", "tls-cert", "tls-key", "tls-server-name", "api-token-file":
+			flagTarget = true
+		}
+	})
+
+	// Flags describing a target replace the targets of the configuration
+	// file, which default to the single target given by flags.
+	if flagTarget || len(cfg.Targets) == 0 {
+		// Use hostname as default server name if not provided
+		servername := *flagServerName
+		if servername == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, fmt.Errorf("get hostname: %w", err)
+			}
+			servername = hostname
+		}
+		t := config.Target{
+			Name:      servername,
+			Address:   *flagServer,
+			State:     *flagState,
+			TokenFile: *flagAPIToken,
+		}
+		if *flagTLS || *flagTLSCA != "" || *flagTLSCert != "" || *flagTLSKey != "" || *flagTLSName != "" {
+			t.TLS = &config.TLS{
+				CA:         *flagTLSCA,
+				Cert:       *flagTLSCert,
+				Key:        *flagTLSKey,
+				ServerName: *flagTLSName,
+			}
+		}
+		cfg.Targets = []config.Target{t}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"go.rikki.moe/v2stat/config"
+)
+
+// parseFlags parses args as the command line, restoring the flags when the
+// test ends.
+func parseFlags(t *testing.T, args ...string) {
+	t.Helper()
+	saved := flag.CommandLine
+	values := make(map[string]string)
+	fs := flag.NewFlagSet("v2stat", flag.ContinueOnError)
+	saved.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	flag.CommandLine = fs
+	t.Cleanup(func() {
+		saved.VisitAll(func(f *flag.Flag) { f.Value.Set(values[f.Name]) })
+		flag.CommandLine = saved
+	})
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v2stat.yaml")
+	err := os.WriteFile(path, []byte(`
+interval: 60
+timeout: 5s
+log_level: error
+influxdb:
+  url: http://file:8086
+  token: from-file
+targets:
+  - name: a
+    address: a:8080
+  - name: b
+    address: b:8080
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("V2STAT_INFLUX_TOKEN", "from-env")
+	t.Setenv("V2STAT_LOG_LEVEL", "warn")
+
+	tests := []struct {
+		name    string
+		args    []string
+		check   func(c *config.Config) bool
+		targets []string
+	}{
+		{
+			name: "file and environment",
+			args: []string{"--config", path},
+			check: func(c *config.Config) bool {
+				return c.Interval == 60 && c.Timeout == config.Duration(5*time.Second) && c.Retries == 3 &&
+					c.InfluxDB.URL == "http://file:8086" && c.InfluxDB.Token == "from-env" && c.LogLevel == "warn"
+			},
+			targets: []string{"a", "b"},
+		},
+		{
+			// Flags left at their defaults do not override the file.
+			name: "flags",
+			args: []string{"--config", path, "--token", "from-flag", "--log-level", "debug", "--retries", "0"},
+			check: func(c *config.Config) bool {
+				return c.Interval == 60 && c.Retries == 0 && c.InfluxDB.Token == "from-flag" && c.LogLevel == "debug"
+			},
+			targets: []string{"a", "b"},
+		},
+		{
+			name:    "target flags",
+			args:    []string{"--config", path, "--server", "c:8080", "--name", "c"},
+			check:   func(c *config.Config) bool { return c.Targets[0].Address == "c:8080" && c.Targets[0].Interval == 60 },
+			targets: []string{"c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parseFlags(t, tt.args...)
+			cfg, err := loadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(cfg) {
+				t.Errorf("got %+v", cfg)
+			}
+			var names []string
+			for _, target := range cfg.Targets {
+				names = append(names, target.Name)
+			}
+			if !slices.Equal(names, tt.targets) {
+				t.Errorf("targets %q, want %q", names, tt.targets)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+
+	"go.rikki.moe/v2stat/config"
+)
+
+// socketPath returns the path of a unix:///path or unix:path address.
+func socketPath(address string) (string, bool) {
+	if path, ok := strings.CutPrefix(address, "unix://"); ok {
+		return path, true
+	}
+	return strings.CutPrefix(address, "unix:")
+}
+
+// errSocketDown completes the errors of checkSocket that are expected to go
+// away once V2Ray is up.
+var errSocketDown = errors.New("is V2Ray running?")
+
+// checkSocket explains why the Unix socket at path cannot be connected to,
+// if that is the case.
+func checkSocket(path string) error {
+	fi, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("socket %s does not exist, %w", path, errSocketDown)
+	}
+	if err != nil {
+		return fmt.Errorf("socket %s: %w", path, err)
+	}
+	if fi.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("%s is not a Unix socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if errors.Is(err, syscall.EACCES) {
+		return fmt.Errorf("permission denied connecting to socket %s, v2stat needs write access to it", path)
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("nothing is listening on socket %s, %w", path, errSocketDown)
+	}
+	if err != nil {
+		return fmt.Errorf("socket %s: %w", path, err)
+	}
+	conn.Close()
+	return nil
+}
+
+// dial creates a client connection to the V2Ray API of the target. Besides
+// host:port, the address may be a Unix socket as unix:///path. Keepalive
+// pings are sent every ping unless it is 0.
+func dial(t config.Target, ping time.Duration) (*grpc.ClientConn, error) {
+	if path, ok := socketPath(t.Address); ok {
+		if path == "" {
+			return nil, fmt.Errorf("invalid address %s, expected unix:///path/to/socket", t.Address)
+		}
+		if err := checkSocket(path); err != nil {
+			// V2Ray may just not be up yet, in which case the scrapes keep
+			// retrying, but a wrong path or permissions will not fix
+			// themselves.
+			if !errors.Is(err, errSocketDown) {
+				return nil, err
+			}
+			logger.Warn(err)
+		}
+	}
+
+	var opts []grpc.DialOption
+	if t.TLS != nil {
+		tlsConfig, err := newTLSConfig(t.TLS)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	if t.Token != "" || len(t.Metadata) > 0 {
+		opts = append(opts, grpc.WithPerRPCCredentials(&rpcCredentials{
+			token:    t.Token,
+			metadata: t.Metadata,
+		}))
+	}
+	if ping > 0 {
+		// Pings are only sent during calls, as V2Ray rejects clients pinging
+		// idle connections.
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    ping,
+			Timeout: ping,
+		}))
+	}
+	return grpc.NewClient(t.Address, opts...)
+}
+
+// watchState connects conn and logs its state changes until ctx is canceled,
+// calling ready, if set, whenever the connection becomes ready.
+func watchState(ctx context.Context, conn *grpc.ClientConn, log logrus.FieldLogger, ready func()) {
+	state := conn.GetState()
+	// Connections are otherwise only made by the first call, which may be
+	// a whole interval away with aligned scrapes.
+	conn.Connect()
+	for conn.WaitForStateChange(ctx, state) {
+		state = conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			log.Info("Connected to V2Ray API")
+			if ready != nil {
+				ready()
+			}
+		case connectivity.TransientFailure:
+			log.Warn("Connection to V2Ray API failed")
+		default:
+			log.Debugf("V2Ray API connection is %s", state)
+		}
+	}
+}
+
+func newTLSConfig(c *config.TLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CA != "" {
+		pem, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("read CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// rpcCredentials attaches a bearer token and static metadata to every call.
+type rpcCredentials struct {
+	token    string
+	metadata map[string]string
+}
+
+func (c *rpcCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	md := make(map[string]string, len(c.metadata)+1)
+	for k, v := range c.metadata {
+		md[k] = v
+	}
+	if c.token != "" {
+		md["authorization"] = "Bearer " + c.token
+	}
+	return md, nil
+}
+
+// RequireTransportSecurity keeps the token from being sent in plaintext.
+func (c *rpcCredentials) RequireTransportSecurity() bool {
+	return c.token != ""
+}
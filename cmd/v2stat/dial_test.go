@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.rikki.moe/v2stat/config"
+)
+
+// writeCert writes a self-signed certificate for name and its key as PEM
+// files to dir and returns their paths along with the certificate.
+func writeCert(t *testing.T, dir, name string) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	writePEM(t, certPath, "CERTIFICATE", der)
+	writePEM(t, keyPath, "EC PRIVATE KEY", keyDER)
+	return certPath, keyPath, cert
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	caPath, _, ca := writeCert(t, dir, "v2ray.internal")
+	certPath, keyPath, _ := writeCert(t, dir, "client")
+	_, otherKey, _ := writeCert(t, dir, "other")
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.pem")
+
+	tests := []struct {
+		name  string
+		tls   config.TLS
+		err   string
+		roots bool
+		certs int
+	}{
+		{"defaults", config.TLS{}, "", false, 0},
+		{"server name", config.TLS{ServerName: "v2ray.internal", InsecureSkipVerify: true}, "", false, 0},
+		{"CA", config.TLS{CA: caPath}, "", true, 0},
+		{"client certificate", config.TLS{CA: caPath, Cert: certPath, Key: keyPath}, "", true, 1},
+		{"missing CA", config.TLS{CA: missing}, "read CA", false, 0},
+		{"CA without certificates", config.TLS{CA: garbage}, "no certificates found", false, 0},
+		{"CA is a key", config.TLS{CA: keyPath}, "no certificates found", false, 0},
+		{"missing key", config.TLS{Cert: certPath}, "load client certificate", false, 0},
+		{"missing key file", config.TLS{Cert: certPath, Key: missing}, "load client certificate", false, 0},
+		{"bad certificate", config.TLS{Cert: garbage, Key: keyPath}, "load client certificate", false, 0},
+		{"bad key", config.TLS{Cert: certPath, Key: garbage}, "load client certificate", false, 0},
+		{"mismatched key", config.TLS{Cert: certPath, Key: otherKey}, "load client certificate", false, 0},
+	}
+	for _, tt := range tests {
+		c, err := newTLSConfig(&tt.tls)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if c.ServerName != tt.tls.ServerName || c.InsecureSkipVerify != tt.tls.InsecureSkipVerify {
+			t.Errorf("%s: server name %q, insecure %v, want %q, %v", tt.name, c.ServerName, c.InsecureSkipVerify, tt.tls.ServerName, tt.tls.InsecureSkipVerify)
+		}
+		if (c.RootCAs != nil) != tt.roots {
+			t.Errorf("%s: root CAs set %v, want %v", tt.name, c.RootCAs != nil, tt.roots)
+		}
+		if c.RootCAs != nil {
+			if _, err := ca.Verify(x509.VerifyOptions{Roots: c.RootCAs, DNSName: "v2ray.internal"}); err != nil {
+				t.Errorf("%s: CA not trusted: %v", tt.name, err)
+			}
+		}
+		if len(c.Certificates) != tt.certs {
+			t.Errorf("%s: got %d client certificates, want %d", tt.name, len(c.Certificates), tt.certs)
+		}
+	}
+}
+
+func TestRPCCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		creds    rpcCredentials
+		want     map[string]string
+		requires bool
+	}{
+		{"token", rpcCredentials{token: "secret"}, map[string]string{"authorization": "Bearer secret"}, true},
+		{"metadata", rpcCredentials{metadata: map[string]string{"x-tenant": "a"}}, map[string]string{"x-tenant": "a"}, false},
+		{
+			"both",
+			rpcCredentials{token: "secret", metadata: map[string]string{"x-tenant": "a", "authorization": "Basic x"}},
+			map[string]string{"x-tenant": "a", "authorization": "Bearer secret"},
+			true,
+		},
+		{"none", rpcCredentials{}, map[string]string{}, false},
+	}
+	for _, tt := range tests {
+		md, err := tt.creds.GetRequestMetadata(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(md, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, md, tt.want)
+		}
+		if got := tt.creds.RequireTransportSecurity(); got != tt.requires {
+			t.Errorf("%s: RequireTransportSecurity() = %v, want %v", tt.name, got, tt.requires)
+		}
+	}
+
+	// The metadata of the configuration is not modified.
+	creds := rpcCredentials{token: "secret", metadata: map[string]string{"x-tenant": "a"}}
+	creds.GetRequestMetadata(context.Background())
+	if len(creds.metadata) != 1 {
+		t.Errorf("metadata modified: %v", creds.metadata)
+	}
+}
+
+func TestSocketPath(t *testing.T) {
+	tests := []struct {
+		address string
+		path    string
+		ok      bool
+	}{
+		{"unix:///run/v2ray/api.sock", "/run/v2ray/api.sock", true},
+		{"unix:/run/v2ray/api.sock", "/run/v2ray/api.sock", true},
+		{"unix:api.sock", "api.sock", true},
+		{"unix://", "", true},
+		{"127.0.0.1:8080", "", false},
+		{"dns:///v2ray:8080", "", false},
+	}
+	for _, tt := range tests {
+		path, ok := socketPath(tt.address)
+		if ok != tt.ok || (ok && path != tt.path) {
+			t.Errorf("socketPath(%q) = %q, %v, want %q, %v", tt.address, path, ok, tt.path, tt.ok)
+		}
+	}
+}
+
+// listenUnix listens on a Unix socket at path until the test ends.
+func listenUnix(t *testing.T, path string) *net.UnixListener {
+	t.Helper()
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestCheckSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	listening := filepath.Join(dir, "listening.sock")
+	listenUnix(t, listening)
+
+	// The socket file stays behind when nothing listens on it anymore.
+	stale := filepath.Join(dir, "stale.sock")
+	l := listenUnix(t, stale)
+	l.SetUnlinkOnClose(false)
+	l.Close()
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, path, err string
+		down            bool
+	}{
+		{"listening", listening, "", false},
+		{"missing", filepath.Join(dir, "missing.sock"), "does not exist", true},
+		{"stale", stale, "nothing is listening", true},
+		{"regular file", file, "is not a Unix socket", false},
+		{"directory", dir, "is not a Unix socket", false},
+	}
+	for _, tt := range tests {
+		err := checkSocket(tt.path)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+		if errors.Is(err, errSocketDown) != tt.down {
+			t.Errorf("%s: error %v expected to go away once V2Ray is up: %v", tt.name, err, !tt.down)
+		}
+	}
+
+	// Connecting fails without write access to the socket, unless the test
+	// runs as root.
+	unwritable := filepath.Join(dir, "unwritable.sock")
+	listenUnix(t, unwritable)
+	if err := os.Chmod(unwritable, 0o400); err != nil {
+		t.Fatal(err)
+	}
+	if os.Geteuid() == 0 {
+		t.Log("Running as root, skipping permission check")
+		return
+	}
+	err := checkSocket(unwritable)
+	if err == nil || !strings.Contains(err.Error(), "permission denied") || errors.Is(err, errSocketDown) {
+		t.Errorf("unwritable socket: got error %v, want permission denied", err)
+	}
+}
+
+func TestDialSocket(t *testing.T) {
+	logger = logrus.New()
+	logger.SetOutput(io.Discard)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		address string
+		err     string
+	}{
+		{"unix://", "invalid address"},
+		{"unix://" + file, "is not a Unix socket"},
+		// V2Ray may still come up.
+		{"unix://" + filepath.Join(dir, "missing.sock"), ""},
+	}
+	for _, tt := range tests {
+		conn, err := dial(config.Target{Address: tt.address}, 0)
+		if conn != nil {
+			conn.Close()
+		}
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("dial(%q): %v", tt.address, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("dial(%q): got error %v, want %q", tt.address, err, tt.err)
+		}
+	}
+}
@@ -3,111 +3,347 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"github.com/influxdata/influxdb-client-go/v2"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 
+	"go.rikki.moe/v2stat/alert"
+	"go.rikki.moe/v2stat/api"
 	"go.rikki.moe/v2stat/command"
+	"go.rikki.moe/v2stat/config"
+	"go.rikki.moe/v2stat/health"
+	"go.rikki.moe/v2stat/notify"
+	"go.rikki.moe/v2stat/quota"
+	"go.rikki.moe/v2stat/sink"
+	"go.rikki.moe/v2stat/stats"
+	"go.rikki.moe/v2stat/systemd"
+	"go.rikki.moe/v2stat/web"
 )
 
 var (
-	flagServerName  = flag.String("name", "", "Name of the server")
-	flagInterval    = flag.Int("interval", 300, "Interval in seconds to record stats")
-	flagInflux      = flag.String("influx", "", "URL to InfluxDB database")
-	flagInfluxToken = flag.String("token", "", "InfluxDB token")
-	flagOrg         = flag.String("org", "", "InfluxDB organization")
-	flagBucket      = flag.String("bucket", "", "InfluxDB bucket")
-	flagServer      = flag.String("server", "127.0.0.1:8080", "V2Ray API server address")
-	flagLogLevel    = flag.String("log-level", "info", "Log level (debug, info, warn, error, fatal, panic)")
+	flagConfig        = flag.String("config", "", "Path to configuration file")
+	flagServerName    = flag.String("name", "", "Name of the server")
+	flagInterval      = flag.Int("interval", 300, "Interval in seconds to record stats")
+	flagAlign         = flag.Bool("align", false, "Scrape on multiples of the interval, e.g. at :00, :05 and :10, and stamp stats with them")
+	flagOffset        = flag.Duration("offset", 0, "Delay of aligned scrapes past the interval boundary")
+	flagJitter        = flag.Duration("jitter", 0, "Maximum random delay added to --offset, chosen once per target")
+	flagShutdown      = flag.Duration("shutdown-timeout", 10*time.Second, "Time allowed for the final scrape and flushing buffered stats on shutdown")
+	flagTimeout       = flag.Duration("timeout", 10*time.Second, "Timeout of every call to the V2Ray API")
+	flagRetries       = flag.Int("retries", 3, "Number of times a failed scrape is retried within the interval")
+	flagKeepalive     = flag.Duration("keepalive", 0, "Interval of gRPC keepalive pings to the V2Ray API, 0 to disable")
+	flagInflux        = flag.String("influx", "", "URL to InfluxDB database")
+	flagInfluxToken   = flag.String("token", "", "InfluxDB token")
+	flagOrg           = flag.String("org", "", "InfluxDB organization")
+	flagBucket        = flag.String("bucket", "", "InfluxDB bucket")
+	flagServer        = flag.String("server", "127.0.0.1:8080", "V2Ray API server address")
+	flagSpool         = flag.String("spool", "", "Directory to buffer InfluxDB writes in while InfluxDB is unavailable")
+	flagSpoolMax      = flag.Int("spool-max", 0, "Maximum number of batches to buffer, 0 for no limit")
+	flagDB            = flag.String("db", "", "Path to SQLite database")
+	flagListen        = flag.String("listen", "", "Address to serve Prometheus metrics on at /metrics, e.g. :9550")
+	flagDashboard     = flag.Bool("dashboard", false, "Serve a web dashboard of the SQLite database at /dashboard/ on --listen")
+	flagDashPassword  = flag.String("dashboard-password-file", "", "File with the password dashboard users authenticate with, as user v2stat unless configured otherwise")
+	flagHTTPAPI       = flag.Bool("http-api", false, "Serve the HTTP JSON API at /api/v1/ on --listen")
+	flagHTTPAPITokens = flag.String("http-api-token-file", "", "File with the bearer tokens clients of the HTTP JSON API authenticate with, one per line")
+	flagInclude       = flag.String("include", "", "Comma-separated patterns of stat names to collect")
+	flagExclude       = flag.String("exclude", "", "Comma-separated patterns of stat names not to collect")
+	flagRegexp        = flag.Bool("regexp", false, "Treat --include and --exclude patterns as regular expressions")
+	flagTLS           = flag.Bool("tls", false, "Use TLS for the connection to the V2Ray API server")
+	flagTLSCA         = flag.String("tls-ca", "", "PEM file with CA certificates to verify the V2Ray API server with")
+	flagTLSCert       = flag.String("tls-cert", "", "PEM file with a client certificate for mTLS")
+	flagTLSKey        = flag.String("tls-key", "", "PEM file with the key of the client certificate")
+	flagTLSName       = flag.String("tls-server-name", "", "Server name to verify the V2Ray API server certificate against")
+	flagAPIToken      = flag.String("api-token-file", "", "File with a bearer token to send to the V2Ray API server")
+	flagState         = flag.String("state", "", "Query counters without resetting them and keep the last seen values in this file")
+	flagLogLevel      = flag.String("log-level", "info", "Log level (debug, info, warn, error, fatal, panic)")
+	flagLogFormat     = flag.String("log-format", "text", "Log format (text, json)")
 )
 
 var logger *logrus.Logger
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "report":
+			if err := runReport(os.Args[2:]); err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		case "query":
+			if err := runQuery(os.Args[2:]); err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		}
+	}
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: v2stat [flags]\n       v2stat report [flags]\n       v2stat query [flags] [pattern...]\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	logger = setupLogger(*flagLogLevel)
+	cfg, err := loadConfig()
+	if err != nil {
+		logrus.Fatalf("Invalid configuration: %v", err)
+	}
+	logger = setupLogger(cfg.LogLevel, cfg.LogFormat)
 
-	// Use hostname as default server name if not provided
-	servername := *flagServerName
-	if servername == "" {
-		hostname, err := os.Hostname()
-		if err != nil {
-			logger.Fatalf("Failed to get hostname: %v", err)
+	a := &app{
+		cfg:     cfg,
+		sinks:   &sink.Multi{},
+		running: make(map[string]*running),
+	}
+	// The monitor tracks the health of v2stat itself if there is an HTTP
+	// server to report it on.
+	if cfg.Listen != "" {
+		a.monitor = health.New()
+		a.sinks.Observe = func(name string, b *stats.Batch, err error) {
+			a.monitor.ObserveSink(name, len(b.Stats), err)
 		}
-		servername = hostname
 	}
-	logger.Infof("Using server name: %s", servername)
 
-	// Set up gRPC connection to V2Ray API server
-	conn, err := grpc.NewClient(*flagServer, grpc.WithInsecure())
+	// Set up sinks
+	if err := a.openSinks(cfg); err != nil {
+		logger.Fatalf("Failed to set up sinks: %v", err)
+	}
+	// Deferred first so the sinks, including the database the HTTP handlers
+	// read, are closed after the HTTP server.
+	defer func() {
+		if err := a.sinks.Close(); err != nil {
+			logger.Errorf("Failed to close sinks: %v", err)
+		}
+	}()
+	if cfg.Listen != "" {
+		prom := sink.NewPrometheus()
+		if err := prom.Register(a.monitor); err != nil {
+			logger.Fatalf("Failed to register metrics: %v", err)
+		}
+		a.sinks.Add("prometheus", prom)
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", prom.Handler())
+		mux.HandleFunc("/healthz", a.monitor.Healthz)
+		mux.HandleFunc("/readyz", a.monitor.Readyz)
+		// The database is not reloaded while it is used by handlers.
+		db, _ := a.sinks.Get("sqlite").(*sink.SQLite)
+		if cfg.Dashboard {
+			var dashboard http.Handler = web.New(db.DB(), logger)
+			if auth := cfg.DashboardAuth; auth.Password != "" {
+				dashboard = web.BasicAuth(dashboard, auth.Username, auth.Password)
+			} else {
+				logger.Warn("The dashboard shows per-user traffic without authentication, set dashboard_auth unless --listen is only reachable by trusted clients")
+			}
+			mux.Handle("/dashboard/", http.StripPrefix("/dashboard", dashboard))
+		}
+		if cfg.HTTPAPI.Enabled {
+			httpAPI := api.New(db.DB(), cfg.HTTPAPI.Tokens, logger)
+			a.sinks.Add("api", httpAPI)
+			mux.Handle("/api/v1/", http.StripPrefix("/api/v1", httpAPI))
+		}
+		server := &http.Server{Addr: cfg.Listen, Handler: mux}
+		go func() {
+			logger.Infof("Serving HTTP on %s", cfg.Listen)
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Fatalf("Failed to serve HTTP: %v", err)
+			}
+		}()
+		defer func() {
+			// Let requests in progress finish before the database is closed.
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+			}
+		}()
+	}
+	if !hasSinks(cfg) {
+		logger.Fatalf("No storage configured, use --influx, --db and/or --listen")
+	}
+
+	if len(cfg.Alerts.Rules) > 0 {
+		a.alerts.Store(newAlertEngine(cfg.Alerts))
+	}
+	defer func() {
+		if e := a.alerts.Load(); e != nil {
+			e.Close()
+		}
+	}()
+
+	if systemd.Enabled() {
+		a.sd = &notifier{}
+	}
+	fresh, err := a.prepare(cfg, false)
 	if err != nil {
-		logger.Fatalf("Failed to connect to V2Ray API server: %v", err)
+		logger.Fatalf("Failed to set up %v", err)
 	}
-	defer conn.Close()
-	client := command.NewStatsServiceClient(conn)
-	if client == nil {
-		logger.Fatalf("Failed to create V2Ray API client")
+	a.start(fresh)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if a.sd != nil {
+		if timeout := systemd.WatchdogInterval(); timeout > 0 {
+			logger.Infof("Pinging systemd watchdog every %s", timeout/2)
+			go a.sd.watchdog(ctx, timeout)
+		}
 	}
 
-	// Set up InfluxDB client
-	influxClient := influxdb2.NewClient(*flagInflux, *flagInfluxToken)
-	defer influxClient.Close()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		logger.Infof("Received signal: %s", sig)
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if a.sd != nil {
+			a.sd.reloading()
+		}
+		a.reload()
+		if a.sd != nil {
+			a.sd.reloaded()
+		}
+	}
+	if err := systemd.Notify("STOPPING=1"); err != nil {
+		logger.Warnf("Failed to notify systemd: %v", err)
+	}
+	a.stop()
+}
 
-	// Create a new point batch
-	bp := influxClient.WriteAPIBlocking(*flagOrg, *flagBucket)
+// newCollector connects to the V2Ray API of the target.
+func newCollector(cfg *config.Config, t config.Target, s *sink.Multi) (*collector, *grpc.ClientConn, error) {
+	var filters []*stats.Filter
+	for _, fc := range []config.Filter{cfg.Filter, t.Filter} {
+		f, err := fc.Compile()
+		if err != nil {
+			return nil, nil, err
+		}
+		filters = append(filters, f)
+	}
 
-	ticker := time.NewTicker(time.Duration(*flagInterval) * time.Second)
-	defer ticker.Stop()
-	killsig := make(chan os.Signal, 1)
-	signal.Notify(killsig, syscall.SIGINT, syscall.SIGTERM)
+	// Set up gRPC connection to V2Ray API server
+	conn, err := dial(t, time.Duration(cfg.Keepalive))
+	if err != nil {
+		return nil, nil, fmt.Errorf("connect to V2Ray API server: %w", err)
+	}
 
-	for {
-		now := time.Now()
-		stats, err := client.QueryStats(context.Background(), &command.QueryStatsRequest{
-			Reset_: true,
-		})
+	c := &collector{
+		name:            t.Name,
+		client:          command.NewStatsServiceClient(conn),
+		sink:            s,
+		interval:        time.Duration(t.Interval) * time.Second,
+		align:           cfg.Align,
+		shutdownTimeout: time.Duration(cfg.ShutdownTimeout),
+		timeout:         time.Duration(cfg.Timeout),
+		retries:         cfg.Retries,
+		filters:         filters,
+		log:             logger.WithField("target", t.Name),
+	}
+	if cfg.Align {
+		c.delay = time.Duration(cfg.Offset)
+		if cfg.Jitter > 0 {
+			c.delay += rand.N(time.Duration(cfg.Jitter))
+		}
+	}
+	if path, ok := socketPath(t.Address); ok {
+		c.socket = path
+	}
+	if t.State != "" {
+		c.tracker, err = stats.LoadTracker(t.State, c.interval)
 		if err != nil {
-			logger.Errorf("Failed to get stats: %v", err)
-			goto LOOP_FINAL
-		}
-
-		// Write stats to InfluxDB
-		for _, stat := range stats.Stat {
-			point := influxdb2.NewPoint(
-				"v2ray_stats",
-				map[string]string{"server": servername, "stat": stat.Name},
-				map[string]interface{}{"value": stat.Value},
-				now,
-			)
-			if err := bp.WritePoint(context.Background(), point); err != nil {
-				logger.Errorf("Failed to write point to InfluxDB: %v", err)
-			}
+			conn.Close()
+			return nil, nil, fmt.Errorf("load counter state: %w", err)
 		}
+		c.log.Infof("Non-destructive mode, keeping counter state in %s", t.State)
+	}
+	return c, conn, nil
+}
 
-LOOP_FINAL:
-		select {
-		case <-ticker.C:
-			continue
-		case sig := <-killsig:
-			logger.Infof("Received signal: %s", sig)
-			return
+// newQuota creates the quota tracker described by the configuration.
+func newQuota(qc config.Quota) (*quota.Quota, error) {
+	opts := quota.Options{
+		StatePath: qc.State,
+		ResetDay:  qc.ResetDay,
+		Limits:    make(map[string]quota.Limit, len(qc.Users)),
+		Default:   quota.Limit{Soft: int64(qc.Default.Soft), Hard: int64(qc.Default.Hard)},
+		Logger:    logger.WithField("component", "quota"),
+	}
+	for _, u := range qc.Users {
+		opts.Limits[u.Email] = quota.Limit{Soft: int64(u.Soft), Hard: int64(u.Hard)}
+	}
+	for _, h := range qc.Hooks {
+		var action quota.Action = &quota.WebhookAction{URL: h.Webhook}
+		if len(h.Command) > 0 {
+			action = &quota.CommandAction{Argv: h.Command}
 		}
+		opts.Hooks = append(opts.Hooks, quota.Hook{Level: quota.Level(h.Level), Action: action})
 	}
+	return quota.New(opts)
+}
 
+// newAlertEngine creates the alerting engine described by the configuration.
+func newAlertEngine(ac config.Alerts) *alert.Engine {
+	rules := make([]alert.Rule, 0, len(ac.Rules))
+	for _, r := range ac.Rules {
+		rules = append(rules, alert.Rule{
+			Name:      r.Name,
+			Type:      r.Type,
+			Server:    r.Server,
+			Kind:      r.Kind,
+			Target:    r.Target,
+			Direction: r.Direction,
+			Threshold: int64(r.Threshold),
+			Window:    time.Duration(r.Window),
+			Scrapes:   r.Scrapes,
+		})
+	}
+	notifiers := make([]alert.Notifier, 0, len(ac.Notifiers))
+	for _, n := range ac.Notifiers {
+		switch {
+		case n.Stdout:
+			notifiers = append(notifiers, &alert.Writer{W: os.Stdout})
+		case n.Webhook != "":
+			notifiers = append(notifiers, &alert.Webhook{URL: n.Webhook})
+		case n.Email != nil:
+			notifiers = append(notifiers, &alert.Email{
+				SMTP: notify.SMTP{
+					Addr:     n.Email.SMTP,
+					Username: n.Email.Username,
+					Password: n.Email.Password,
+					From:     n.Email.From,
+				},
+				To: n.Email.To,
+			})
+		}
+	}
+	return alert.NewEngine(rules, notifiers, logger.WithField("component", "alert"))
 }
 
-func setupLogger(levelStr string) *logrus.Logger {
+func setupLogger(levelStr, format string) *logrus.Logger {
+	logger := logrus.New()
+	if err := configureLogger(logger, levelStr, format); err != nil {
+		logrus.Fatalf("Invalid log level: %v", err)
+	}
+	return logger
+}
+
+// configureLogger sets the level and format of logger, which also applies to
+// the loggers derived from it.
+func configureLogger(logger *logrus.Logger, levelStr, format string) error {
 	level, err := logrus.ParseLevel(levelStr)
 	if err != nil {
-		logrus.Fatalf("Invalid log level: %v", err)
+		return err
 	}
-	logger := logrus.New()
 	logger.SetLevel(level)
-	return logger
+	if format == "json" {
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logger.SetFormatter(&logrus.TextFormatter{})
+	}
+	return nil
 }
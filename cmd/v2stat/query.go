@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"go.rikki.moe/v2stat/command"
+	"go.rikki.moe/v2stat/config"
+	"go.rikki.moe/v2stat/stats"
+)
+
+// queryTimeout bounds the calls of the query subcommand.
+const queryTimeout = 10 * time.Second
+
+// runQuery implements the query subcommand, printing the live counters or
+// runtime state of a V2Ray server.
+func runQuery(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: v2stat query [flags] [pattern...]\n\nPrint the current counters of a V2Ray server, optionally only those matching\nany of the patterns.\n\n")
+		fs.PrintDefaults()
+	}
+	var (
+		configPath = fs.String("config", "", "Path to configuration file")
+		target     = fs.String("target", "", "Name of the configured target to query, defaults to the first")
+		server     = fs.String("server", "127.0.0.1:8080", "V2Ray API server address, overrides --config")
+		tlsOn      = fs.Bool("tls", false, "Use TLS for the connection to the V2Ray API server")
+		tlsCA      = fs.String("tls-ca", "", "PEM file with CA certificates to verify the V2Ray API server with")
+		tlsCert    = fs.String("tls-cert", "", "PEM file with a client certificate for mTLS")
+		tlsKey     = fs.String("tls-key", "", "PEM file with the key of the client certificate")
+		tlsName    = fs.String("tls-server-name", "", "Server name to verify the V2Ray API server certificate against")
+		tokenFile  = fs.String("api-token-file", "", "File with a bearer token to send to the V2Ray API server")
+		name       = fs.String("stat", "", "Query a single counter by its full name")
+		sys        = fs.Bool("sys", false, "Query the runtime state instead of counters")
+		regexp     = fs.Bool("regexp", false, "Treat patterns as regular expressions")
+		reset      = fs.Bool("reset", false, "Reset the queried counters")
+		format     = fs.String("format", "human", "Output format (human, json, csv)")
+	)
+	fs.Parse(args)
+
+	// dial logs warnings through the global logger.
+	logger = setupLogger("warn", "text")
+
+	var t config.Target
+	var err error
+	if *configPath != "" && !isFlagSet(fs, "server") {
+		t, err = configTarget(*configPath, *target)
+	} else {
+		t = config.Target{Name: *server, Address: *server, TokenFile: *tokenFile}
+		if *tlsOn || *tlsCA != "" || *tlsCert != "" || *tlsKey != "" || *tlsName != "" {
+			t.TLS = &config.TLS{CA: *tlsCA, Cert: *tlsCert, Key: *tlsKey, ServerName: *tlsName}
+		}
+		t, err = validTarget(t)
+	}
+	if err != nil {
+		return err
+	}
+
+	conn, err := dial(t, 0)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := command.NewStatsServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	if *sys {
+		resp, err := client.GetSysStats(ctx, &command.SysStatsRequest{})
+		if err != nil {
+			return err
+		}
+		return printSys(os.Stdout, *format, stats.NewSysStats(resp))
+	}
+
+	list, err := queryStats(ctx, client, *name, fs.Args(), *regexp, *reset)
+	if err != nil {
+		return err
+	}
+	return printStats(os.Stdout, *format, list)
+}
+
+// queryStats returns the counter of the given name, or the counters matching
+// any of patterns ordered by name, resetting them if reset is set.
+func queryStats(ctx context.Context, client command.StatsServiceClient, name string, patterns []string, regexp, reset bool) ([]stats.Stat, error) {
+	if name != "" {
+		resp, err := client.GetStats(ctx, &command.GetStatsRequest{Name: name, Reset_: reset})
+		if err != nil {
+			return nil, err
+		}
+		return []stats.Stat{{Name: resp.Stat.Name, Value: resp.Stat.Value}}, nil
+	}
+	resp, err := client.QueryStats(ctx, &command.QueryStatsRequest{
+		Patterns: patterns,
+		Regexp:   regexp,
+		Reset_:   reset,
+	})
+	if err != nil {
+		return nil, err
+	}
+	list := stats.NewBatch(time.Now(), "", resp.Stat).Stats
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// configTarget returns the target of the given name, or the first target,
+// from the configuration file.
+func configTarget(path, name string) (config.Target, error) {
+	cfg := config.Default()
+	if err := cfg.Load(path); err != nil {
+		return config.Target{}, err
+	}
+	cfg.ApplyEnv()
+	if err := cfg.Validate(); err != nil {
+		return config.Target{}, err
+	}
+	if name == "" {
+		return cfg.Targets[0], nil
+	}
+	for _, t := range cfg.Targets {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return config.Target{}, fmt.Errorf("no target named %q in %s", name, path)
+}
+
+// validTarget validates a target given by flags.
+func validTarget(t config.Target) (config.Target, error) {
+	cfg := config.Default()
+	cfg.Targets = []config.Target{t}
+	if err := cfg.Validate(); err != nil {
+		return config.Target{}, err
+	}
+	return cfg.Targets[0], nil
+}
+
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func printStats(w io.Writer, format string, list []stats.Stat) error {
+	switch format {
+	case "human":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tVALUE")
+		for _, s := range list {
+			fmt.Fprintf(tw, "%s\t%s\n", s.Name, stats.FormatBytes(s.Value))
+		}
+		return tw.Flush()
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"name", "value"})
+		for _, s := range list {
+			cw.Write([]string{s.Name, strconv.FormatInt(s.Value, 10)})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		if list == nil {
+			list = []stats.Stat{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func printSys(w io.Writer, format string, s *stats.SysStats) error {
+	rows := []struct {
+		name  string
+		value uint64
+		bytes bool
+	}{
+		{"num_goroutine", uint64(s.NumGoroutine), false},
+		{"num_gc", uint64(s.NumGC), false},
+		{"alloc", s.Alloc, true},
+		{"total_alloc", s.TotalAlloc, true},
+		{"sys", s.Sys, true},
+		{"mallocs", s.Mallocs, false},
+		{"frees", s.Frees, false},
+		{"live_objects", s.LiveObjects, false},
+		{"pause_total_ns", s.PauseTotalNs, false},
+		{"uptime", uint64(s.Uptime), false},
+	}
+	switch format {
+	case "human":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, r := range rows {
+			value := strconv.FormatUint(r.value, 10)
+			switch {
+			case r.bytes:
+				value = stats.FormatBytes(int64(r.value))
+			case r.name == "pause_total_ns":
+				value = time.Duration(r.value).String()
+			case r.name == "uptime":
+				value = (time.Duration(r.value) * time.Second).String()
+			}
+			fmt.Fprintf(tw, "%s\t%s\n", r.name, value)
+		}
+		return tw.Flush()
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"name", "value"})
+		for _, r := range rows {
+			cw.Write([]string{r.name, strconv.FormatUint(r.value, 10)})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
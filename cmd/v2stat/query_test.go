@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	"go.rikki.moe/v2stat/command"
+	"go.rikki.moe/v2stat/stats"
+)
+
+// recordingClient records the requests it gets and serves fixed counters.
+type recordingClient struct {
+	command.StatsServiceClient
+	query *command.QueryStatsRequest
+	get   *command.GetStatsRequest
+}
+
+func (c *recordingClient) QueryStats(ctx context.Context, in *command.QueryStatsRequest, opts ...grpc.CallOption) (*command.QueryStatsResponse, error) {
+	c.query = in
+	return &command.QueryStatsResponse{Stat: []*command.Stat{
+		{Name: "user>>>bob@x>>>traffic>>>uplink", Value: 2},
+		{Name: "inbound>>>api>>>traffic>>>uplink", Value: 3},
+		{Name: "user>>>alice@x>>>traffic>>>uplink", Value: 1},
+	}}, nil
+}
+
+func (c *recordingClient) GetStats(ctx context.Context, in *command.GetStatsRequest, opts ...grpc.CallOption) (*command.GetStatsResponse, error) {
+	c.get = in
+	return &command.GetStatsResponse{Stat: &command.Stat{Name: in.Name, Value: 42}}, nil
+}
+
+func TestQueryStats(t *testing.T) {
+	tests := []struct {
+		name     string
+		stat     string
+		patterns []string
+		regexp   bool
+		reset    bool
+	}{
+		{"all", "", nil, false, false},
+		{"patterns", "", []string{"user>>>", "inbound>>>"}, false, false},
+		{"regexp with reset", "", []string{"^user>>>.*>>>uplink$"}, true, true},
+		{"single", "user>>>alice@x>>>traffic>>>uplink", nil, false, false},
+		{"single with reset", "user>>>alice@x>>>traffic>>>uplink", []string{"ignored"}, true, true},
+	}
+	for _, tt := range tests {
+		client := &recordingClient{}
+		list, err := queryStats(context.Background(), client, tt.stat, tt.patterns, tt.regexp, tt.reset)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.stat != "" {
+			if client.query != nil || client.get == nil || client.get.Name != tt.stat || client.get.Reset_ != tt.reset {
+				t.Errorf("%s: got GetStats %+v and QueryStats %+v", tt.name, client.get, client.query)
+			}
+			if len(list) != 1 || list[0] != (stats.Stat{Name: tt.stat, Value: 42}) {
+				t.Errorf("%s: got %+v", tt.name, list)
+			}
+			continue
+		}
+		req := client.query
+		if client.get != nil || req == nil || !slices.Equal(req.Patterns, tt.patterns) || req.Regexp != tt.regexp || req.Reset_ != tt.reset {
+			t.Errorf("%s: got QueryStats %+v and GetStats %+v", tt.name, req, client.get)
+		}
+		// Counters are ordered by name.
+		var names []string
+		for _, s := range list {
+			names = append(names, s.Name)
+		}
+		want := []string{"inbound>>>api>>>traffic>>>uplink", "user>>>alice@x>>>traffic>>>uplink", "user>>>bob@x>>>traffic>>>uplink"}
+		if !slices.Equal(names, want) {
+			t.Errorf("%s: got %v, want %v", tt.name, names, want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{-1023, "-1023 B"},
+		{1024, "1.00 KiB"},
+		{1536, "1.50 KiB"},
+		{1<<20 - 1, "1024.00 KiB"},
+		{5 << 30, "5.00 GiB"},
+		{3 << 40, "3.00 TiB"},
+		{-2 << 20, "-2.00 MiB"},
+		{1 << 62, "4.00 EiB"},
+	}
+	for _, tt := range tests {
+		if got := stats.FormatBytes(tt.n); got != tt.want {
+			t.Errorf("FormatBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPrintStats(t *testing.T) {
+	list := []stats.Stat{
+		{Name: "user>>>alice@x>>>traffic>>>uplink", Value: 1536},
+		{Name: "inbound>>>api>>>traffic>>>uplink", Value: 100},
+	}
+	tests := []struct {
+		format string
+		list   []stats.Stat
+		want   string
+	}{
+		{"human", list, "NAME                               VALUE\n" +
+			"user>>>alice@x>>>traffic>>>uplink  1.50 KiB\n" +
+			"inbound>>>api>>>traffic>>>uplink   100 B\n"},
+		{"csv", list, "name,value\n" +
+			"user>>>alice@x>>>traffic>>>uplink,1536\n" +
+			"inbound>>>api>>>traffic>>>uplink,100\n"},
+		{"json", list[:1], "[\n  {\n    \"name\": \"user>>>alice@x>>>traffic>>>uplink\",\n    \"value\": 1536\n  }\n]\n"},
+		{"json", nil, "[]\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := printStats(&buf, tt.format, tt.list); err != nil {
+			t.Fatalf("%s: %v", tt.format, err)
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tt.format, got, tt.want)
+		}
+	}
+	if err := printStats(&bytes.Buffer{}, "xml", list); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestPrintSysHuman(t *testing.T) {
+	var buf bytes.Buffer
+	s := &stats.SysStats{
+		NumGoroutine: 12,
+		Alloc:        3 << 20,
+		TotalAlloc:   5 << 30,
+		Sys:          512,
+		PauseTotalNs: 1_500_000,
+		Uptime:       3725,
+	}
+	if err := printSys(&buf, "human", s); err != nil {
+		t.Fatal(err)
+	}
+	want := "num_goroutine   12\n" +
+		"num_gc          0\n" +
+		"alloc           3.00 MiB\n" +
+		"total_alloc     5.00 GiB\n" +
+		"sys             512 B\n" +
+		"mallocs         0\n" +
+		"frees           0\n" +
+		"live_objects    0\n" +
+		"pause_total_ns  1.5ms\n" +
+		"uptime          1h2m5s\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
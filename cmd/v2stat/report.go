@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"go.rikki.moe/v2stat/config"
+	"go.rikki.moe/v2stat/stats"
+	"go.rikki.moe/v2stat/store"
+)
+
+// runReport implements the report subcommand, printing the traffic of every
+// user, inbound and outbound within a time range.
+func runReport(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: v2stat report [flags]\n\nPrint per-user and per-inbound traffic totals from the storage backend.\n\n")
+		fs.PrintDefaults()
+	}
+	var (
+		configPath = fs.String("config", "", "Path to configuration file")
+		db         = fs.String("db", "", "Path to SQLite database")
+		influx     = fs.String("influx", "", "URL to InfluxDB database")
+		token      = fs.String("token", "", "InfluxDB token")
+		org        = fs.String("org", "", "InfluxDB organization")
+		bucket     = fs.String("bucket", "", "InfluxDB bucket")
+		rangeName  = fs.String("range", "today", "Time range (today, yesterday, 7d, 30d, month, last-month, or a month as YYYY-MM)")
+		from       = fs.String("from", "", "Start date as YYYY-MM-DD, overrides --range")
+		to         = fs.String("to", "", "End date as YYYY-MM-DD, exclusive, defaults to now")
+		server     = fs.String("name", "", "Only report the server of this name")
+		format     = fs.String("format", "table", "Output format (table, csv, json)")
+	)
+	fs.Parse(args)
+
+	cfg := config.Default()
+	if *configPath != "" {
+		if err := cfg.Load(*configPath); err != nil {
+			return err
+		}
+	}
+	cfg.ApplyEnv()
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "db":
+			cfg.SQLite.Path = *db
+		case "influx":
+			cfg.InfluxDB.URL = *influx
+		case "token":
+			cfg.InfluxDB.Token = *token
+		case "org":
+			cfg.InfluxDB.Org = *org
+		case "bucket":
+			cfg.InfluxDB.Bucket = *bucket
+		}
+	})
+
+	start, end, err := parseRange(*rangeName, *from, *to, time.Now())
+	if err != nil {
+		return err
+	}
+	reader, err := openReader(cfg)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	totals, err := reader.Totals(context.Background(), start, end, *server)
+	if err != nil {
+		return err
+	}
+	usage := stats.Aggregate(totals)
+
+	switch *format {
+	case "table":
+		return printUsageTable(os.Stdout, start, end, usage)
+	case "csv":
+		return printUsageCSV(os.Stdout, usage)
+	case "json":
+		return printUsageJSON(os.Stdout, start, end, usage)
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+}
+
+// openReader opens the storage backend to read stats from, preferring the
+// local SQLite database. The database is not created or migrated, it may be
+// in use by a v2stat of another version.
+func openReader(cfg *config.Config) (store.Reader, error) {
+	if cfg.SQLite.Path != "" {
+		return store.OpenReadOnly(cfg.SQLite.Path)
+	}
+	if ic := cfg.InfluxDB; ic.URL != "" {
+		return store.OpenInflux(ic.URL, ic.Token, ic.Org, ic.Bucket), nil
+	}
+	return nil, fmt.Errorf("no storage configured, use --db or --influx")
+}
+
+// parseRange returns the time range [start, end) selected by the flags.
+func parseRange(name, from, to string, now time.Time) (time.Time, time.Time, error) {
+	var start, end time.Time
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	end = now
+	switch name {
+	case "today":
+		start = today
+	case "yesterday":
+		start, end = today.AddDate(0, 0, -1), today
+	case "7d":
+		start = today.AddDate(0, 0, -6)
+	case "30d":
+		start = today.AddDate(0, 0, -29)
+	case "month":
+		start = thisMonth
+	case "last-month":
+		start, end = thisMonth.AddDate(0, -1, 0), thisMonth
+	default:
+		month, err := time.ParseInLocation("2006-01", name, now.Location())
+		if err != nil {
+			return start, end, fmt.Errorf("invalid range %q", name)
+		}
+		start, end = month, month.AddDate(0, 1, 0)
+	}
+
+	var err error
+	if from != "" {
+		if start, err = time.ParseInLocation(time.DateOnly, from, now.Location()); err != nil {
+			return start, end, fmt.Errorf("invalid start date: %w", err)
+		}
+		end = now
+	}
+	if to != "" {
+		if end, err = time.ParseInLocation(time.DateOnly, to, now.Location()); err != nil {
+			return start, end, fmt.Errorf("invalid end date: %w", err)
+		}
+	}
+	if !start.Before(end) {
+		return start, end, fmt.Errorf("empty time range %s to %s", start.Format(time.DateTime), end.Format(time.DateTime))
+	}
+	return start, end, nil
+}
+
+func printUsageTable(w io.Writer, start, end time.Time, usage []stats.Usage) error {
+	fmt.Fprintf(w, "Traffic from %s to %s\n\n", start.Format("2006-01-02 15:04"), end.Format("2006-01-02 15:04"))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tTARGET\tUPLINK\tDOWNLINK\tTOTAL")
+	for _, u := range usage {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", u.Kind, u.Target,
+			stats.FormatBytes(u.Uplink), stats.FormatBytes(u.Downlink), stats.FormatBytes(u.Total()))
+	}
+	return tw.Flush()
+}
+
+func printUsageCSV(w io.Writer, usage []stats.Usage) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"kind", "target", "uplink", "downlink", "total"})
+	for _, u := range usage {
+		cw.Write([]string{
+			u.Kind,
+			u.Target,
+			strconv.FormatInt(u.Uplink, 10),
+			strconv.FormatInt(u.Downlink, 10),
+			strconv.FormatInt(u.Total(), 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func printUsageJSON(w io.Writer, start, end time.Time, usage []stats.Usage) error {
+	out := struct {
+		From  time.Time     `json:"from"`
+		To    time.Time     `json:"to"`
+		Usage []stats.Usage `json:"usage"`
+	}{From: start, To: end, Usage: usage}
+	if out.Usage == nil {
+		out.Usage = []stats.Usage{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
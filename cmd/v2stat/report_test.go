@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+func TestParseRange(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	now := time.Date(2025, 3, 31, 15, 30, 0, 0, time.UTC)
+	newYear := time.Date(2025, 1, 1, 0, 10, 0, 0, time.UTC)
+	tests := []struct {
+		name, from, to string
+		now            time.Time
+		start, end     time.Time
+	}{
+		{"today", "", "", now, date(2025, 3, 31), now},
+		{"yesterday", "", "", now, date(2025, 3, 30), date(2025, 3, 31)},
+		{"yesterday", "", "", newYear, date(2024, 12, 31), date(2025, 1, 1)},
+		{"7d", "", "", now, date(2025, 3, 25), now},
+		{"7d", "", "", newYear, date(2024, 12, 26), newYear},
+		{"30d", "", "", now, date(2025, 3, 2), now},
+		{"month", "", "", now, date(2025, 3, 1), now},
+		{"month", "", "", newYear, date(2025, 1, 1), newYear},
+		{"last-month", "", "", now, date(2025, 2, 1), date(2025, 3, 1)},
+		{"last-month", "", "", newYear, date(2024, 12, 1), date(2025, 1, 1)},
+		{"2024-02", "", "", now, date(2024, 2, 1), date(2024, 3, 1)},
+		{"2024-12", "", "", now, date(2024, 12, 1), date(2025, 1, 1)},
+		// --from and --to override the range.
+		{"today", "2025-02-27", "", now, date(2025, 2, 27), now},
+		{"today", "2025-02-27", "2025-03-02", now, date(2025, 2, 27), date(2025, 3, 2)},
+		{"last-month", "", "2025-02-15", now, date(2025, 2, 1), date(2025, 2, 15)},
+	}
+	for _, tt := range tests {
+		start, end, err := parseRange(tt.name, tt.from, tt.to, tt.now)
+		if err != nil {
+			t.Errorf("%s %s-%s at %s: %v", tt.name, tt.from, tt.to, tt.now, err)
+			continue
+		}
+		if !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("%s %s-%s at %s = %s - %s, want %s - %s", tt.name, tt.from, tt.to, tt.now, start, end, tt.start, tt.end)
+		}
+	}
+
+	for _, tt := range []struct{ name, from, to, err string }{
+		{"week", "", "", "invalid range"},
+		{"2025-13", "", "", "invalid range"},
+		{"today", "2025-02-30", "", "invalid start date"},
+		{"today", "", "tomorrow", "invalid end date"},
+		{"today", "2025-03-02", "2025-03-01", "empty time range"},
+		{"today", "", "2025-03-31", "empty time range"},
+	} {
+		_, _, err := parseRange(tt.name, tt.from, tt.to, now)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s %s-%s: got error %v, want %q", tt.name, tt.from, tt.to, err, tt.err)
+		}
+	}
+}
+
+var testUsage = []stats.Usage{
+	{Kind: stats.KindUser, Target: "alice@x", Uplink: 1536, Downlink: 3 << 20},
+	{Kind: stats.KindInbound, Target: "vmess", Uplink: 100, Downlink: 0},
+}
+
+func TestPrintUsage(t *testing.T) {
+	start := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2025, 3, 31, 15, 30, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	if err := printUsageTable(&buf, start, end, testUsage); err != nil {
+		t.Fatal(err)
+	}
+	want := "Traffic from 2025-03-01 00:00 to 2025-03-31 15:30\n\n" +
+		"KIND     TARGET   UPLINK    DOWNLINK  TOTAL\n" +
+		"user     alice@x  1.50 KiB  3.00 MiB  3.00 MiB\n" +
+		"inbound  vmess    100 B     0 B       100 B\n"
+	if got := buf.String(); got != want {
+		t.Errorf("table:\n%s\nwant:\n%s", got, want)
+	}
+
+	buf.Reset()
+	if err := printUsageCSV(&buf, testUsage); err != nil {
+		t.Fatal(err)
+	}
+	want = "kind,target,uplink,downlink,total\n" +
+		"user,alice@x,1536,3145728,3147264\n" +
+		"inbound,vmess,100,0,100\n"
+	if got := buf.String(); got != want {
+		t.Errorf("csv:\n%s\nwant:\n%s", got, want)
+	}
+
+	buf.Reset()
+	if err := printUsageJSON(&buf, start, end, testUsage); err != nil {
+		t.Fatal(err)
+	}
+	want = `{
+  "from": "2025-03-01T00:00:00Z",
+  "to": "2025-03-31T15:30:00Z",
+  "usage": [
+    {
+      "kind": "user",
+      "target": "alice@x",
+      "uplink": 1536,
+      "downlink": 3145728,
+      "total": 3147264
+    },
+    {
+      "kind": "inbound",
+      "target": "vmess",
+      "uplink": 100,
+      "downlink": 0,
+      "total": 100
+    }
+  ]
+}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("json:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Without traffic, the usage is an empty list rather than null.
+	buf.Reset()
+	if err := printUsageJSON(&buf, start, end, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"usage": []`) {
+		t.Errorf("json without usage:\n%s", buf.String())
+	}
+}
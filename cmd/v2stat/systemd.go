@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"go.rikki.moe/v2stat/stats"
+	"go.rikki.moe/v2stat/systemd"
+)
+
+// notifier reports the progress of the collectors to systemd: READY=1 once
+// the first connection to a V2Ray API is established, the last scrape as
+// STATUS and watchdog pings as long as no collector is stuck.
+type notifier struct {
+	mu         sync.Mutex
+	ready      bool
+	collectors []*collector
+}
+
+// add adds a collector to watch.
+func (n *notifier) add(c *collector) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.collectors = append(n.collectors, c)
+	c.systemd = n
+}
+
+// remove stops watching a collector.
+func (n *notifier) remove(c *collector) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.collectors = slices.DeleteFunc(n.collectors, func(o *collector) bool { return o == c })
+}
+
+// scraped reports a scrape of c.
+func (n *notifier) scraped(c *collector, now time.Time, batch *stats.Batch, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var state string
+	if err != nil {
+		state = fmt.Sprintf("STATUS=Failed to scrape %s at %s: %v", c.name, now.Format(time.DateTime), err)
+	} else {
+		state = fmt.Sprintf("STATUS=Scraped %d stats from %s at %s", len(batch.Stats), c.name, now.Format(time.DateTime))
+		if !n.ready {
+			n.ready = true
+			state = "READY=1\n" + state
+		}
+	}
+	if err := systemd.Notify(state); err != nil {
+		logger.Warnf("Failed to notify systemd: %v", err)
+	}
+}
+
+// connected reports that c connected to its V2Ray API. Aligned scrapes may
+// not run for a whole interval, so readiness does not wait for them.
+func (n *notifier) connected(c *collector) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ready {
+		return
+	}
+	n.ready = true
+	if err := systemd.Notify(fmt.Sprintf("READY=1\nSTATUS=Connected to %s", c.name)); err != nil {
+		logger.Warnf("Failed to notify systemd: %v", err)
+	}
+}
+
+// reloading reports that the configuration is being reloaded.
+func (n *notifier) reloading() {
+	if err := systemd.Notify("RELOADING=1"); err != nil {
+		logger.Warnf("Failed to notify systemd: %v", err)
+	}
+}
+
+// reloaded reports that the configuration was reloaded, which makes v2stat
+// ready again unless it has not been ready before.
+func (n *notifier) reloaded() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.ready {
+		return
+	}
+	if err := systemd.Notify("READY=1"); err != nil {
+		logger.Warnf("Failed to notify systemd: %v", err)
+	}
+}
+
+// watchdog pings the systemd watchdog, which expects pings within timeout,
+// until ctx is canceled. Pings are withheld while a collector is stuck so
+// systemd restarts v2stat.
+func (n *notifier) watchdog(ctx context.Context, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if c := n.stuck(time.Now()); c != nil {
+			c.log.Errorf("Collector is stuck, withholding watchdog ping")
+			continue
+		}
+		if err := systemd.Notify("WATCHDOG=1"); err != nil {
+			logger.Warnf("Failed to notify systemd: %v", err)
+		}
+	}
+}
+
+// stuck returns a collector stuck in a scrape, or nil.
+func (n *notifier) stuck(now time.Time) *collector {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, c := range n.collectors {
+		if c.stuck(now) {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+// notifySocket listens on a temporary NOTIFY_SOCKET for the duration of
+// the test.
+func notifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// receive returns the datagrams arriving on conn within wait.
+func receive(conn *net.UnixConn, wait time.Duration) []string {
+	var out []string
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(wait))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return out
+		}
+		out = append(out, string(buf[:n]))
+	}
+}
+
+func testNotifierLogger() *logrus.Logger {
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	return l
+}
+
+func TestNotifierReady(t *testing.T) {
+	conn := notifySocket(t)
+	logger = testNotifierLogger()
+	n := &notifier{}
+	c := &collector{name: "a", log: logger}
+	n.add(c)
+	now := time.Date(2025, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	// Not ready before a reload completes either.
+	n.reloaded()
+	n.scraped(c, now, nil, errors.New("connection refused"))
+	got := receive(conn, 50*time.Millisecond)
+	if len(got) != 1 || strings.Contains(got[0], "READY=1") || !strings.Contains(got[0], "STATUS=Failed to scrape a") {
+		t.Fatalf("after a failed scrape got %q, want a status without READY=1", got)
+	}
+
+	n.scraped(c, now, &stats.Batch{Stats: make([]stats.Stat, 3)}, nil)
+	n.scraped(c, now, &stats.Batch{}, nil)
+	got = receive(conn, 50*time.Millisecond)
+	if len(got) != 2 || got[0] != "READY=1\nSTATUS=Scraped 3 stats from a at 2025-04-01 12:00:00" || strings.Contains(got[1], "READY=1") {
+		t.Fatalf("after successful scrapes got %q, want READY=1 once", got)
+	}
+
+	// Ready again after reloads.
+	n.reloading()
+	n.reloaded()
+	if got := receive(conn, 50*time.Millisecond); len(got) != 2 || got[0] != "RELOADING=1" || got[1] != "READY=1" {
+		t.Errorf("on reload got %q", got)
+	}
+}
+
+func TestNotifierReadyOnConnect(t *testing.T) {
+	conn := notifySocket(t)
+	logger = testNotifierLogger()
+	n := &notifier{}
+	c := &collector{name: "a", log: logger}
+	n.add(c)
+
+	n.connected(c)
+	n.connected(c)
+	n.scraped(c, time.Now(), &stats.Batch{}, nil)
+	got := receive(conn, 50*time.Millisecond)
+	if len(got) != 2 || !strings.HasPrefix(got[0], "READY=1\n") || strings.Contains(got[1], "READY=1") {
+		t.Errorf("got %q, want READY=1 once on connect", got)
+	}
+}
+
+func TestNotifierWatchdog(t *testing.T) {
+	conn := notifySocket(t)
+	logger = testNotifierLogger()
+	n := &notifier{}
+	c := &collector{name: "a", log: logger, interval: time.Minute, timeout: time.Second, shutdownTimeout: time.Second}
+	n.add(c)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.watchdog(ctx, 20*time.Millisecond)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if got := receive(conn, 100*time.Millisecond); len(got) == 0 || got[0] != "WATCHDOG=1" {
+		t.Fatalf("got %q, want watchdog pings", got)
+	}
+
+	// Pings are withheld while the collector is stuck.
+	c.busySince.Store(time.Now().Add(-time.Hour).UnixNano())
+	receive(conn, 20*time.Millisecond)
+	if got := receive(conn, 100*time.Millisecond); len(got) != 0 {
+		t.Fatalf("got %q while stuck, want no pings", got)
+	}
+
+	// A collector that was removed does not hold pings back.
+	n.remove(c)
+	if got := receive(conn, 100*time.Millisecond); len(got) == 0 || got[0] != "WATCHDOG=1" {
+		t.Errorf("got %q after removing the stuck collector, want pings", got)
+	}
+}
@@ -0,0 +1,636 @@
+// Package config loads the v2stat configuration file.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"go.rikki.moe/v2stat/alert"
+	"go.rikki.moe/v2stat/stats"
+)
+
+// Config is the content of a configuration file.
+type Config struct {
+	// Interval in seconds between scrapes.
+	Interval int `json:"interval"`
+	// Align schedules scrapes on multiples of the interval since the Unix
+	// epoch, e.g. at :00, :05 and :10 with an interval of 300, and stamps
+	// stats with the boundary time.
+	Align bool `json:"align"`
+	// Offset delays aligned scrapes past the boundary.
+	Offset Duration `json:"offset"`
+	// Jitter adds a random delay of up to Jitter to Offset, chosen once per
+	// target, so a fleet of nodes doesn't scrape in the same second.
+	Jitter Duration `json:"jitter"`
+	// Timeout bounds every call to the V2Ray API.
+	Timeout Duration `json:"timeout"`
+	// Retries is the number of times a failed scrape is retried, with
+	// exponential backoff, as long as the retries fit into the interval.
+	Retries int `json:"retries"`
+	// Keepalive is the interval of gRPC keepalive pings while calls are in
+	// flight, 0 to disable them.
+	Keepalive Duration `json:"keepalive"`
+	// ShutdownTimeout bounds everything left to do on shutdown: scrapes and
+	// writes in progress, the final scrape and the flush of the sinks. It
+	// also bounds every write to the sinks.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// LogLevel is one of debug, info, warn, error, fatal or panic.
+	LogLevel string `json:"log_level"`
+	// LogFormat is text or json.
+	LogFormat string `json:"log_format"`
+	// Listen is the address to serve HTTP endpoints on.
+	Listen string `json:"listen"`
+	// Dashboard serves a web dashboard of the SQLite database at
+	// /dashboard/ on Listen.
+	Dashboard bool `json:"dashboard"`
+	// DashboardAuth protects the dashboard with HTTP basic authentication.
+	DashboardAuth BasicAuth `json:"dashboard_auth"`
+	// HTTPAPI serves the HTTP JSON API at /api/v1/ on Listen.
+	HTTPAPI HTTPAPI `json:"http_api"`
+
+	// Filter selects the stats collected from every target.
+	Filter   Filter   `json:"filter"`
+	Targets  []Target `json:"targets"`
+	InfluxDB InfluxDB `json:"influxdb"`
+	SQLite   SQLite   `json:"sqlite"`
+	Quota    Quota    `json:"quota"`
+	Alerts   Alerts   `json:"alerts"`
+}
+
+// Target is a V2Ray server to collect stats from.
+type Target struct {
+	// Name identifies the server in collected stats. Defaults to Address.
+	Name string `json:"name"`
+	// Address of the V2Ray API.
+	Address string `json:"address"`
+	// Pattern is a shorthand for including the stats with names containing
+	// it in Filter.
+	Pattern string `json:"pattern"`
+	// Filter selects the stats collected from this target, in addition to
+	// the global filter.
+	Filter Filter `json:"filter"`
+	// Interval in seconds between scrapes, defaults to the global interval.
+	Interval int `json:"interval"`
+	// State enables non-destructive mode, keeping counter state in this file.
+	State string `json:"state"`
+
+	// TLS enables TLS for the connection to the API if set.
+	TLS *TLS `json:"tls"`
+	// Token is sent as a bearer token with every call. It requires TLS.
+	Token string `json:"token"`
+	// TokenFile is a file to read Token from.
+	TokenFile string `json:"token_file"`
+	// Metadata is sent as gRPC metadata with every call.
+	Metadata map[string]string `json:"metadata"`
+}
+
+// TLS configures TLS for the connection to a V2Ray API, usually fronted by a
+// TLS proxy. The system roots are used if CA is empty.
+type TLS struct {
+	// CA is a PEM file with the certificates to verify the server with.
+	CA string `json:"ca"`
+	// Cert and Key are PEM files with a client certificate for mTLS.
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// ServerName overrides the name the server certificate is verified
+	// against, which defaults to the host of the address.
+	ServerName string `json:"server_name"`
+	// InsecureSkipVerify disables verification of the server certificate.
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+// Filter selects stats by name. Patterns are substrings, or regular
+// expressions if Regexp is set. Includes are matched by V2Ray where possible,
+// excludes are always applied by v2stat.
+type Filter struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+	Regexp  bool     `json:"regexp"`
+}
+
+// Compile checks the patterns and returns the filter for collecting stats.
+func (f Filter) Compile() (*stats.Filter, error) {
+	return stats.NewFilter(f.Include, f.Exclude, f.Regexp)
+}
+
+// InfluxDB configures the InfluxDB sink, which is enabled if URL is set.
+type InfluxDB struct {
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Org    string `json:"org"`
+	Bucket string `json:"bucket"`
+	// Spool is the directory to buffer writes in while InfluxDB is
+	// unavailable.
+	Spool string `json:"spool"`
+	// SpoolMax is the maximum number of buffered batches, 0 for no limit.
+	SpoolMax int `json:"spool_max"`
+}
+
+// SQLite configures the SQLite sink, which is enabled if Path is set.
+type SQLite struct {
+	Path string `json:"path"`
+	// Retention is how long samples are kept at each resolution.
+	Retention Retention `json:"retention"`
+}
+
+// Retention is how long raw samples and hourly, daily and monthly rollups
+// are kept, 0 to keep them forever.
+type Retention struct {
+	Raw     Duration `json:"raw"`
+	Hourly  Duration `json:"hourly"`
+	Daily   Duration `json:"daily"`
+	Monthly Duration `json:"monthly"`
+}
+
+// HTTPAPI configures the HTTP JSON API, which is enabled if Enabled is set.
+type HTTPAPI struct {
+	Enabled bool `json:"enabled"`
+	// Tokens are the bearer tokens clients may authenticate with.
+	Tokens []string `json:"tokens"`
+	// TokenFile is a file with one token per line, added to Tokens.
+	TokenFile string `json:"token_file"`
+}
+
+// BasicAuth configures HTTP basic authentication, which is required if a
+// password is set.
+type BasicAuth struct {
+	// Username defaults to v2stat.
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// PasswordFile is a file holding the password, used instead of
+	// Password.
+	PasswordFile string `json:"password_file"`
+}
+
+// ByteSize is a number of bytes, given as a number or a string such as
+// "100GiB".
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("invalid size %s", data)
+		}
+		*b = ByteSize(n)
+		return nil
+	}
+	n, err := stats.ParseBytes(s)
+	if err != nil {
+		return err
+	}
+	*b = ByteSize(n)
+	return nil
+}
+
+// Duration is a duration given as a string such as "30m" or "90d". The
+// number 0 is accepted as well, other numbers lack a unit.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n float64
+		if err := json.Unmarshal(data, &n); err != nil || n != 0 {
+			return fmt.Errorf("invalid duration %s", data)
+		}
+		*d = 0
+		return nil
+	}
+	parse := time.ParseDuration
+	if strings.HasSuffix(s, "d") {
+		parse = stats.ParseDuration
+	}
+	v, err := parse(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Quota configures per-user traffic quotas, which are enabled if State is
+// set.
+type Quota struct {
+	// State is the file usage of the current period is kept in.
+	State string `json:"state"`
+	// ResetDay is the day of the month billing periods start on, 1 to 28.
+	ResetDay int `json:"reset_day"`
+	// Default applies to users not listed in Users.
+	Default QuotaLimit   `json:"default"`
+	Users   []QuotaLimit `json:"users"`
+	Hooks   []QuotaHook  `json:"hooks"`
+}
+
+// QuotaLimit is the traffic allowed to a user per billing period. Zero means
+// no limit.
+type QuotaLimit struct {
+	Email string   `json:"email"`
+	Soft  ByteSize `json:"soft"`
+	Hard  ByteSize `json:"hard"`
+}
+
+// QuotaHook is run when a user crosses a limit of Level, or any limit if it
+// is empty. Exactly one of Command and Webhook must be set.
+type QuotaHook struct {
+	Level   string   `json:"level"`
+	Command []string `json:"command"`
+	Webhook string   `json:"webhook"`
+}
+
+// Alerts configures alerting rules and where their notifications go.
+type Alerts struct {
+	Rules     []AlertRule     `json:"rules"`
+	Notifiers []AlertNotifier `json:"notifiers"`
+}
+
+// AlertRule is an alerting rule, see package alert for the types.
+type AlertRule struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Server    string   `json:"server"`
+	Kind      string   `json:"kind"`
+	Target    string   `json:"target"`
+	Direction string   `json:"direction"`
+	Threshold ByteSize `json:"threshold"`
+	Window    Duration `json:"window"`
+	Scrapes   int      `json:"scrapes"`
+}
+
+// AlertNotifier is a destination for alert notifications. Exactly one of
+// its fields must be set.
+type AlertNotifier struct {
+	Stdout  bool   `json:"stdout"`
+	Webhook string `json:"webhook"`
+	Email   *Email `json:"email"`
+}
+
+// Email configures delivery of notifications by mail.
+type Email struct {
+	// SMTP is the host:port of the mail server.
+	SMTP     string   `json:"smtp"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// Default returns the configuration used for settings not given anywhere.
+func Default() *Config {
+	return &Config{
+		Interval:        300,
+		Timeout:         Duration(10 * time.Second),
+		Retries:         3,
+		ShutdownTimeout: Duration(10 * time.Second),
+		LogLevel:        "info",
+		LogFormat:       "text",
+	}
+}
+
+// env maps environment variables to the settings they override.
+var env = map[string]func(c *Config, v string){
+	"V2STAT_INFLUX_URL":         func(c *Config, v string) { c.InfluxDB.URL = v },
+	"V2STAT_INFLUX_TOKEN":       func(c *Config, v string) { c.InfluxDB.Token = v },
+	"V2STAT_INFLUX_ORG":         func(c *Config, v string) { c.InfluxDB.Org = v },
+	"V2STAT_INFLUX_BUCKET":      func(c *Config, v string) { c.InfluxDB.Bucket = v },
+	"V2STAT_DB":                 func(c *Config, v string) { c.SQLite.Path = v },
+	"V2STAT_LOG_LEVEL":          func(c *Config, v string) { c.LogLevel = v },
+	"V2STAT_HTTP_API_TOKEN":     func(c *Config, v string) { c.HTTPAPI.Tokens = append(c.HTTPAPI.Tokens, v) },
+	"V2STAT_DASHBOARD_PASSWORD": func(c *Config, v string) { c.DashboardAuth.Password = v },
+	"V2STAT_SMTP_PASSWORD": func(c *Config, v string) {
+		for _, n := range c.Alerts.Notifiers {
+			if n.Email != nil {
+				n.Email.Password = v
+			}
+		}
+	},
+}
+
+// ApplyEnv overrides settings from the environment variables that are set.
+func (c *Config) ApplyEnv() {
+	for name, set := range env {
+		if v, ok := os.LookupEnv(name); ok {
+			set(c, v)
+		}
+	}
+}
+
+// Load reads the configuration file at path on top of c. The format is
+// chosen by the file extension: .yaml or .yml for YAML, .toml for TOML and
+// JSON otherwise.
+func (c *Config) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// YAML and TOML are converted to JSON so a single set of struct tags
+	// describes all formats.
+	var raw map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		err = json.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	data, err = json.Marshal(raw)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks the configuration and fills in defaults.
+func (c *Config) Validate() error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		return err
+	}
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown log format %q", c.LogFormat)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+	// gRPC does not ping more often than every 10 seconds.
+	if c.Keepalive < 0 || (c.Keepalive > 0 && c.Keepalive < Duration(10*time.Second)) {
+		return fmt.Errorf("keepalive must be 0 or at least 10s")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown_timeout must be positive")
+	}
+	if c.Offset < 0 || c.Jitter < 0 {
+		return fmt.Errorf("offset and jitter must not be negative")
+	}
+	if c.Dashboard && c.Listen == "" {
+		return fmt.Errorf("dashboard requires listen to be set")
+	}
+	if c.Dashboard && c.SQLite.Path == "" {
+		return fmt.Errorf("dashboard requires the sqlite database")
+	}
+	if err := c.DashboardAuth.validate(); err != nil {
+		return fmt.Errorf("dashboard_auth: %w", err)
+	}
+	if err := c.HTTPAPI.validate(c); err != nil {
+		return fmt.Errorf("http_api: %w", err)
+	}
+	if r := c.SQLite.Retention; r.Raw < 0 || r.Hourly < 0 || r.Daily < 0 || r.Monthly < 0 {
+		return fmt.Errorf("sqlite: retention must not be negative")
+	}
+	if c.InfluxDB.SpoolMax < 0 {
+		return fmt.Errorf("influxdb: spool_max must not be negative")
+	}
+
+	if _, err := c.Filter.Compile(); err != nil {
+		return fmt.Errorf("filter: %w", err)
+	}
+	if err := c.Quota.validate(); err != nil {
+		return fmt.Errorf("quota: %w", err)
+	}
+	if err := c.Alerts.validate(); err != nil {
+		return fmt.Errorf("alerts: %w", err)
+	}
+
+	if len(c.Targets) == 0 {
+		return fmt.Errorf("no targets configured")
+	}
+	names := make(map[string]bool, len(c.Targets))
+	states := make(map[string]bool, len(c.Targets))
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		if t.Address == "" {
+			return fmt.Errorf("target %d: address is required", i)
+		}
+		if t.Name == "" {
+			t.Name = t.Address
+		}
+		if names[t.Name] {
+			return fmt.Errorf("target %d: duplicate name %q", i, t.Name)
+		}
+		names[t.Name] = true
+		if t.Pattern != "" {
+			p := t.Pattern
+			if t.Filter.Regexp {
+				p = regexp.QuoteMeta(p)
+			}
+			t.Filter.Include = append(t.Filter.Include, p)
+			t.Pattern = ""
+		}
+		if _, err := t.Filter.Compile(); err != nil {
+			return fmt.Errorf("target %s: filter: %w", t.Name, err)
+		}
+		if t.Interval < 0 {
+			return fmt.Errorf("target %s: interval must not be negative", t.Name)
+		}
+		if t.Interval == 0 {
+			t.Interval = c.Interval
+		}
+		if c.Align && time.Duration(c.Offset+c.Jitter) >= time.Duration(t.Interval)*time.Second {
+			return fmt.Errorf("target %s: offset plus jitter must be less than the interval", t.Name)
+		}
+		if t.TLS != nil && (t.TLS.Cert == "") != (t.TLS.Key == "") {
+			return fmt.Errorf("target %s: tls: cert and key must be given together", t.Name)
+		}
+		if t.TokenFile != "" {
+			if t.Token != "" {
+				return fmt.Errorf("target %s: token and token_file are mutually exclusive", t.Name)
+			}
+			data, err := os.ReadFile(t.TokenFile)
+			if err != nil {
+				return fmt.Errorf("target %s: %w", t.Name, err)
+			}
+			t.Token = strings.TrimSpace(string(data))
+			t.TokenFile = ""
+		}
+		if t.Token != "" && t.TLS == nil {
+			return fmt.Errorf("target %s: token requires tls", t.Name)
+		}
+		if t.State != "" {
+			if states[t.State] {
+				return fmt.Errorf("target %s: state file %s is used by another target", t.Name, t.State)
+			}
+			states[t.State] = true
+		}
+	}
+	return nil
+}
+
+func (a *BasicAuth) validate() error {
+	if a.PasswordFile != "" {
+		data, err := os.ReadFile(a.PasswordFile)
+		if err != nil {
+			return err
+		}
+		a.Password = strings.TrimSpace(string(data))
+		a.PasswordFile = ""
+		if a.Password == "" {
+			return fmt.Errorf("password file is empty")
+		}
+	}
+	if a.Password != "" && a.Username == "" {
+		a.Username = "v2stat"
+	}
+	if a.Password == "" && a.Username != "" {
+		return fmt.Errorf("password is required")
+	}
+	return nil
+}
+
+func (a *HTTPAPI) validate(c *Config) error {
+	if !a.Enabled {
+		return nil
+	}
+	if c.Listen == "" {
+		return fmt.Errorf("listen is required")
+	}
+	if c.SQLite.Path == "" {
+		return fmt.Errorf("the sqlite database is required")
+	}
+	if a.TokenFile != "" {
+		data, err := os.ReadFile(a.TokenFile)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if t := strings.TrimSpace(line); t != "" {
+				a.Tokens = append(a.Tokens, t)
+			}
+		}
+		a.TokenFile = ""
+	}
+	if len(a.Tokens) == 0 {
+		return fmt.Errorf("at least one token is required")
+	}
+	for i, t := range a.Tokens {
+		if t == "" {
+			return fmt.Errorf("token %d is empty", i)
+		}
+	}
+	return nil
+}
+
+func (q *Quota) validate() error {
+	if q.State == "" {
+		if len(q.Users) > 0 || len(q.Hooks) > 0 {
+			return fmt.Errorf("state is required")
+		}
+		return nil
+	}
+	if q.ResetDay == 0 {
+		q.ResetDay = 1
+	}
+	if q.ResetDay < 1 || q.ResetDay > 28 {
+		return fmt.Errorf("reset_day must be between 1 and 28")
+	}
+	emails := make(map[string]bool, len(q.Users))
+	for i, u := range q.Users {
+		if u.Email == "" {
+			return fmt.Errorf("user %d: email is required", i)
+		}
+		if emails[u.Email] {
+			return fmt.Errorf("user %d: duplicate email %s", i, u.Email)
+		}
+		emails[u.Email] = true
+	}
+	for i, h := range q.Hooks {
+		switch h.Level {
+		case "", "soft", "hard":
+		default:
+			return fmt.Errorf("hook %d: unknown level %q", i, h.Level)
+		}
+		if (len(h.Command) > 0) == (h.Webhook != "") {
+			return fmt.Errorf("hook %d: exactly one of command and webhook must be set", i)
+		}
+	}
+	return nil
+}
+
+func (a *Alerts) validate() error {
+	names := make(map[string]bool, len(a.Rules))
+	for i, r := range a.Rules {
+		if r.Name == "" {
+			return fmt.Errorf("rule %d: name is required", i)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rule %d: duplicate name %q", i, r.Name)
+		}
+		names[r.Name] = true
+		switch r.Kind {
+		case "", stats.KindUser, stats.KindInbound, stats.KindOutbound:
+		default:
+			return fmt.Errorf("rule %s: unknown kind %q", r.Name, r.Kind)
+		}
+		switch r.Direction {
+		case "", stats.DirectionUplink, stats.DirectionDownlink:
+		default:
+			return fmt.Errorf("rule %s: unknown direction %q", r.Name, r.Direction)
+		}
+		switch r.Type {
+		case alert.NoTraffic:
+			if r.Window <= 0 {
+				return fmt.Errorf("rule %s: window is required", r.Name)
+			}
+		case alert.TrafficAbove:
+			if r.Window <= 0 || r.Threshold <= 0 {
+				return fmt.Errorf("rule %s: window and threshold are required", r.Name)
+			}
+		case alert.Unreachable:
+			if r.Scrapes <= 0 {
+				return fmt.Errorf("rule %s: scrapes is required", r.Name)
+			}
+		default:
+			return fmt.Errorf("rule %s: unknown type %q", r.Name, r.Type)
+		}
+	}
+	if len(a.Rules) > 0 && len(a.Notifiers) == 0 {
+		return fmt.Errorf("no notifiers configured")
+	}
+	for i, n := range a.Notifiers {
+		set := 0
+		if n.Stdout {
+			set++
+		}
+		if n.Webhook != "" {
+			set++
+		}
+		if n.Email != nil {
+			set++
+			if n.Email.SMTP == "" || n.Email.From == "" || len(n.Email.To) == 0 {
+				return fmt.Errorf("notifier %d: email requires smtp, from and to", i)
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("notifier %d: exactly one of stdout, webhook and email must be set", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFormats(t *testing.T) {
+	want := Default()
+	want.Interval = 60
+	want.Timeout = Duration(5 * time.Second)
+	want.SQLite = SQLite{Path: "v2stat.db", Retention: Retention{Raw: Duration(90 * 24 * time.Hour)}}
+	want.Targets = []Target{{Name: "a", Address: "127.0.0.1:8080", Filter: Filter{Include: []string{"user>>>"}}}}
+	want.Quota = Quota{State: "quota.json", Default: QuotaLimit{Soft: 1 << 30}}
+
+	files := map[string]string{
+		"v2stat.yaml": `
+interval: 60
+timeout: 5s
+sqlite:
+  path: v2stat.db
+  retention:
+    raw: 90d
+targets:
+  - name: a
+    address: 127.0.0.1:8080
+    filter:
+      include: ["user>>>"]
+quota:
+  state: quota.json
+  default:
+    soft: 1GiB
+`,
+		"v2stat.toml": `
+interval = 60
+timeout = "5s"
+
+[sqlite]
+path = "v2stat.db"
+retention = { raw = "90d" }
+
+[[targets]]
+name = "a"
+address = "127.0.0.1:8080"
+filter = { include = ["user>>>"] }
+
+[quota]
+state = "quota.json"
+default = { soft = "1GiB" }
+`,
+		"v2stat.json": `{
+  "interval": 60,
+  "timeout": "5s",
+  "sqlite": {"path": "v2stat.db", "retention": {"raw": "90d"}},
+  "targets": [{"name": "a", "address": "127.0.0.1:8080", "filter": {"include": ["user>>>"]}}],
+  "quota": {"state": "quota.json", "default": {"soft": 1073741824}}
+}`,
+	}
+	for name, content := range files {
+		cfg := Default()
+		if err := cfg.Load(writeFile(t, name, content)); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg, want) {
+			t.Errorf("%s: got %+v, want %+v", name, cfg, want)
+		}
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	tests := []struct {
+		name, content, err string
+	}{
+		{"v2stat.yaml", "intervall: 60\n", "unknown field"},
+		{"v2stat.yaml", "targets:\n  - adress: 127.0.0.1:8080\n", "unknown field"},
+		{"v2stat.toml", "[sqlite]\npth = \"v2stat.db\"\n", "unknown field"},
+		{"v2stat.json", `{"interval": "60"}`, "cannot unmarshal"},
+		{"v2stat.yaml", "timeout: 5\n", "invalid duration"},
+		{"v2stat.yaml", "interval: [\n", "parse"},
+	}
+	for _, tt := range tests {
+		err := Default().Load(writeFile(t, tt.name, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s %q: got error %v, want %q", tt.name, tt.content, err, tt.err)
+		}
+	}
+}
+
+func TestLoadZeroDuration(t *testing.T) {
+	cfg := Default()
+	err := cfg.Load(writeFile(t, "v2stat.yaml", `
+sqlite:
+  path: v2stat.db
+  retention:
+    raw: 7d
+    monthly: 0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Retention{Raw: Duration(7 * 24 * time.Hour)}
+	if cfg.SQLite.Retention != want {
+		t.Errorf("got %+v, want %+v", cfg.SQLite.Retention, want)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	cfg := Default()
+	cfg.LogLevel = "warn"
+	cfg.InfluxDB.Token = "from-file"
+	cfg.HTTPAPI.Tokens = []string{"a"}
+	cfg.Alerts.Notifiers = []AlertNotifier{{Stdout: true}, {Email: &Email{Password: "from-file"}}}
+	t.Setenv("V2STAT_INFLUX_TOKEN", "from-env")
+	t.Setenv("V2STAT_HTTP_API_TOKEN", "b")
+	t.Setenv("V2STAT_SMTP_PASSWORD", "secret")
+	cfg.ApplyEnv()
+
+	if cfg.InfluxDB.Token != "from-env" {
+		t.Errorf("influx token = %q, want the environment to override the file", cfg.InfluxDB.Token)
+	}
+	if cfg.LogLevel != "warn" {
+		t.Errorf("log level = %q, want unset variables to keep the file", cfg.LogLevel)
+	}
+	if !reflect.DeepEqual(cfg.HTTPAPI.Tokens, []string{"a", "b"}) {
+		t.Errorf("http api tokens = %q, want the environment added", cfg.HTTPAPI.Tokens)
+	}
+	if cfg.Alerts.Notifiers[1].Email.Password != "secret" {
+		t.Errorf("smtp password = %q, want secret", cfg.Alerts.Notifiers[1].Email.Password)
+	}
+}
+
+func TestValidateTargets(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []Target
+		align   bool
+		want    []Target
+		err     string
+	}{
+		{
+			name:    "defaults",
+			targets: []Target{{Address: "127.0.0.1:8080"}, {Name: "b", Address: "b:8080", Interval: 60}},
+			want:    []Target{{Name: "127.0.0.1:8080", Address: "127.0.0.1:8080", Interval: 300}, {Name: "b", Address: "b:8080", Interval: 60}},
+		},
+		{
+			name:    "pattern",
+			targets: []Target{{Name: "a", Address: "a:8080", Pattern: "alice@x", Filter: Filter{Include: []string{"bob@x"}}}},
+			want:    []Target{{Name: "a", Address: "a:8080", Filter: Filter{Include: []string{"bob@x", "alice@x"}}, Interval: 300}},
+		},
+		{
+			name:    "pattern with regexp",
+			targets: []Target{{Name: "a", Address: "a:8080", Pattern: "alice+x", Filter: Filter{Regexp: true}}},
+			want:    []Target{{Name: "a", Address: "a:8080", Filter: Filter{Include: []string{`alice\+x`}, Regexp: true}, Interval: 300}},
+		},
+		{name: "no targets", err: "no targets configured"},
+		{name: "no address", targets: []Target{{Name: "a"}}, err: "address is required"},
+		{name: "duplicate name", targets: []Target{{Address: "a:8080"}, {Address: "a:8080"}}, err: "duplicate name"},
+		{name: "shared state", targets: []Target{{Name: "a", Address: "a:8080", State: "s.json"}, {Name: "b", Address: "b:8080", State: "s.json"}}, err: "used by another target"},
+		{name: "invalid filter", targets: []Target{{Name: "a", Address: "a:8080", Filter: Filter{Include: []string{"("}, Regexp: true}}}, err: "filter"},
+		{name: "token without tls", targets: []Target{{Name: "a", Address: "a:8080", Token: "t"}}, err: "token requires tls"},
+		{name: "cert without key", targets: []Target{{Name: "a", Address: "a:8080", TLS: &TLS{Cert: "c.pem"}}}, err: "cert and key"},
+		{name: "offset past interval", align: true, targets: []Target{{Name: "a", Address: "a:8080", Interval: 1}}, err: "offset plus jitter"},
+	}
+	for _, tt := range tests {
+		cfg := Default()
+		cfg.Targets = tt.targets
+		if tt.align {
+			cfg.Align, cfg.Offset = true, Duration(time.Second)
+		}
+		err := cfg.Validate()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg.Targets, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, cfg.Targets, tt.want)
+		}
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	tokens := writeFile(t, "tokens", "a\n\nb\n")
+	tests := []struct {
+		name  string
+		edit  func(c *Config)
+		check func(c *Config) bool
+		err   string
+	}{
+		{name: "defaults"},
+		{name: "interval", edit: func(c *Config) { c.Interval = 0 }, err: "interval must be positive"},
+		{name: "log level", edit: func(c *Config) { c.LogLevel = "loud" }, err: "not a valid logrus Level"},
+		{name: "log format", edit: func(c *Config) { c.LogFormat = "xml" }, err: "unknown log format"},
+		{name: "keepalive", edit: func(c *Config) { c.Keepalive = Duration(time.Second) }, err: "keepalive"},
+		{name: "dashboard without listen", edit: func(c *Config) { c.Dashboard, c.SQLite.Path = true, "v.db" }, err: "listen"},
+		{name: "http api tokens", edit: func(c *Config) {
+			c.Listen, c.SQLite.Path = ":9550", "v.db"
+			c.HTTPAPI = HTTPAPI{Enabled: true, TokenFile: tokens}
+		}, check: func(c *Config) bool {
+			return reflect.DeepEqual(c.HTTPAPI.Tokens, []string{"a", "b"}) && c.HTTPAPI.TokenFile == ""
+		}},
+		{name: "http api without tokens", edit: func(c *Config) {
+			c.Listen, c.SQLite.Path = ":9550", "v.db"
+			c.HTTPAPI.Enabled = true
+		}, err: "at least one token"},
+		{name: "dashboard user", edit: func(c *Config) { c.DashboardAuth.Password = "p" }, check: func(c *Config) bool {
+			return c.DashboardAuth.Username == "v2stat"
+		}},
+		{name: "quota reset day", edit: func(c *Config) { c.Quota.State = "q.json" }, check: func(c *Config) bool {
+			return c.Quota.ResetDay == 1
+		}},
+		{name: "quota hook", edit: func(c *Config) {
+			c.Quota.State = "q.json"
+			c.Quota.Hooks = []QuotaHook{{Command: []string{"true"}, Webhook: "http://x"}}
+		}, err: "exactly one of command and webhook"},
+		{name: "alert without notifiers", edit: func(c *Config) {
+			c.Alerts.Rules = []AlertRule{{Name: "down", Type: "unreachable", Scrapes: 3}}
+		}, err: "no notifiers"},
+		{name: "retention", edit: func(c *Config) { c.SQLite.Retention.Raw = -1 }, err: "retention"},
+	}
+	for _, tt := range tests {
+		cfg := Default()
+		cfg.Targets = []Target{{Address: "127.0.0.1:8080"}}
+		if tt.edit != nil {
+			tt.edit(cfg)
+		}
+		err := cfg.Validate()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if tt.check != nil && !tt.check(cfg) {
+			t.Errorf("%s: got %+v", tt.name, cfg)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Package health tracks whether v2stat itself is working, serving health
+// endpoints for orchestrators and metrics about the collection for
+// Prometheus.
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// staleIntervals is the number of intervals after which a target without a
+// successful scrape and write is considered unhealthy.
+const staleIntervals = 3
+
+type target struct {
+	interval time.Duration
+	// added is the time the target was added.
+	added time.Time
+	// lastScrape and lastWrite are the times of the last successful scrape
+	// and write.
+	lastScrape time.Time
+	lastWrite  time.Time
+	lastError  string
+}
+
+// Monitor tracks the scrapes and writes of every target. It implements
+// prometheus.Collector for the metrics about them.
+type Monitor struct {
+	mu      sync.Mutex
+	targets map[string]*target
+
+	scrapeDuration *prometheus.HistogramVec
+	scrapeErrors   *prometheus.CounterVec
+	lastScrape     *prometheus.GaugeVec
+	lastWrite      *prometheus.GaugeVec
+	pointsWritten  *prometheus.CounterVec
+	pointsFailed   *prometheus.CounterVec
+	spool          Spool
+}
+
+// Spool is a spool of batches waiting to be written.
+type Spool interface {
+	Depth() int
+	Dropped() int64
+	Rejected() int64
+}
+
+var (
+	spoolDepthDesc = prometheus.NewDesc(
+		"v2stat_spool_depth",
+		"Number of batches waiting in the spool.",
+		nil, nil,
+	)
+	spoolDroppedDesc = prometheus.NewDesc(
+		"v2stat_spool_dropped_batches_total",
+		"Number of batches dropped because the spool was full.",
+		nil, nil,
+	)
+	spoolRejectedDesc = prometheus.NewDesc(
+		"v2stat_spool_rejected_batches_total",
+		"Number of spooled batches set aside because the sink rejected them.",
+		nil, nil,
+	)
+)
+
+// New creates a monitor without targets.
+func New() *Monitor {
+	return &Monitor{
+		targets: make(map[string]*target),
+		scrapeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "v2stat_scrape_duration_seconds",
+			Help:    "Duration of scrapes of the V2Ray API.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"target"}),
+		scrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "v2stat_scrape_errors_total",
+			Help: "Number of failed scrapes of the V2Ray API, including retries.",
+		}, []string{"target"}),
+		lastScrape: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "v2stat_last_scrape_success_timestamp_seconds",
+			Help: "Time of the last successful scrape.",
+		}, []string{"target"}),
+		lastWrite: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "v2stat_last_write_success_timestamp_seconds",
+			Help: "Time the stats of the target were last written to all sinks.",
+		}, []string{"target"}),
+		pointsWritten: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "v2stat_points_written_total",
+			Help: "Number of stats written to a sink.",
+		}, []string{"sink"}),
+		pointsFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "v2stat_points_failed_total",
+			Help: "Number of stats a sink failed to write, which are retried with its next write.",
+		}, []string{"sink"}),
+	}
+}
+
+// AddTarget adds a target scraped every interval. The state of a target
+// that is already known is kept.
+func (m *Monitor) AddTarget(name string, interval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.targets[name]; ok {
+		t.interval = interval
+		return
+	}
+	m.targets[name] = &target{interval: interval, added: time.Now()}
+}
+
+// RemoveTarget removes a target that is no longer scraped.
+func (m *Monitor) RemoveTarget(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.targets, name)
+}
+
+// SetSpool sets the spool to report the metrics of, nil if there is none.
+func (m *Monitor) SetSpool(s Spool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spool = s
+}
+
+// ObserveScrape records a scrape attempt of the target.
+func (m *Monitor) ObserveScrape(name string, d time.Duration, err error) {
+	m.scrapeDuration.WithLabelValues(name).Observe(d.Seconds())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.targets[name]
+	if err != nil {
+		m.scrapeErrors.WithLabelValues(name).Inc()
+		if t != nil {
+			t.lastError = err.Error()
+		}
+		return
+	}
+	now := time.Now()
+	m.lastScrape.WithLabelValues(name).Set(float64(now.Unix()))
+	if t != nil {
+		t.lastScrape = now
+	}
+}
+
+// ObserveWrite records the write of the stats of the target to all sinks.
+func (m *Monitor) ObserveWrite(name string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.targets[name]
+	if err != nil {
+		if t != nil {
+			t.lastError = err.Error()
+		}
+		return
+	}
+	now := time.Now()
+	m.lastWrite.WithLabelValues(name).Set(float64(now.Unix()))
+	if t != nil {
+		t.lastWrite = now
+		t.lastError = ""
+	}
+}
+
+// ObserveSink records the write of points stats to a single sink.
+func (m *Monitor) ObserveSink(sink string, points int, err error) {
+	if err != nil {
+		m.pointsFailed.WithLabelValues(sink).Add(float64(points))
+	} else {
+		m.pointsWritten.WithLabelValues(sink).Add(float64(points))
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Monitor) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+	ch <- spoolDepthDesc
+	ch <- spoolDroppedDesc
+	ch <- spoolRejectedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (m *Monitor) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+	m.mu.Lock()
+	spool := m.spool
+	m.mu.Unlock()
+	if spool != nil {
+		ch <- prometheus.MustNewConstMetric(spoolDepthDesc, prometheus.GaugeValue, float64(spool.Depth()))
+		ch <- prometheus.MustNewConstMetric(spoolDroppedDesc, prometheus.CounterValue, float64(spool.Dropped()))
+		ch <- prometheus.MustNewConstMetric(spoolRejectedDesc, prometheus.CounterValue, float64(spool.Rejected()))
+	}
+}
+
+func (m *Monitor) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.scrapeDuration, m.scrapeErrors, m.lastScrape, m.lastWrite, m.pointsWritten, m.pointsFailed,
+	}
+}
+
+type targetStatus struct {
+	Healthy    bool       `json:"healthy"`
+	Ready      bool       `json:"ready"`
+	LastScrape *time.Time `json:"last_scrape,omitempty"`
+	LastWrite  *time.Time `json:"last_write,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+// status returns the status of every target, and whether all targets are
+// healthy and ready. A target is ready once it was scraped and written
+// successfully, and healthy unless that has not happened for staleIntervals
+// intervals.
+func (m *Monitor) status(now time.Time) (map[string]targetStatus, bool, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]targetStatus, len(m.targets))
+	healthy, ready := true, true
+	for name, t := range m.targets {
+		lastScrape, lastWrite := t.lastScrape, t.lastWrite
+		s := targetStatus{
+			Ready:     !lastScrape.IsZero() && !lastWrite.IsZero(),
+			LastError: t.lastError,
+		}
+		if !lastScrape.IsZero() {
+			s.LastScrape = &lastScrape
+		}
+		if !lastWrite.IsZero() {
+			s.LastWrite = &lastWrite
+		}
+		// Targets get staleIntervals intervals to start up after they are
+		// added, e.g. on reload.
+		oldest := t.added
+		if s.Ready {
+			oldest = lastScrape
+			if lastWrite.Before(oldest) {
+				oldest = lastWrite
+			}
+		}
+		s.Healthy = now.Sub(oldest) < staleIntervals*t.interval
+		healthy = healthy && s.Healthy
+		ready = ready && s.Ready
+		out[name] = s
+	}
+	return out, healthy, ready
+}
+
+// Healthz serves 200 if every target was scraped and written recently, and
+// 503 otherwise so a wedged v2stat is restarted.
+func (m *Monitor) Healthz(w http.ResponseWriter, r *http.Request) {
+	targets, healthy, _ := m.status(time.Now())
+	writeStatus(w, healthy, targets)
+}
+
+// Readyz serves 200 once every target was scraped and written, and 503
+// before.
+func (m *Monitor) Readyz(w http.ResponseWriter, r *http.Request) {
+	targets, _, ready := m.status(time.Now())
+	writeStatus(w, ready, targets)
+}
+
+func writeStatus(w http.ResponseWriter, ok bool, targets map[string]targetStatus) {
+	status, code := "ok", http.StatusOK
+	if !ok {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status  string                  `json:"status"`
+		Targets map[string]targetStatus `json:"targets"`
+	}{status, targets})
+}
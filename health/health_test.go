@@ -0,0 +1,31 @@
+package health
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddedTargetGetsStartUpTime(t *testing.T) {
+	m := New()
+	m.AddTarget("a", time.Minute)
+	now := time.Now()
+	// a was added an hour ago and is up to date.
+	a := m.targets["a"]
+	a.added = now.Add(-time.Hour)
+	a.lastScrape, a.lastWrite = now, now
+
+	// b is added on reload and has not been scraped yet.
+	m.AddTarget("b", time.Minute)
+	targets, healthy, ready := m.status(now.Add(2 * time.Minute))
+	if !targets["b"].Healthy || !healthy {
+		t.Errorf("new target unhealthy within its start-up time: %+v", targets)
+	}
+	if targets["b"].Ready || ready {
+		t.Errorf("new target ready before its first scrape: %+v", targets)
+	}
+
+	targets, healthy, _ = m.status(now.Add(staleIntervals*time.Minute + time.Second))
+	if targets["b"].Healthy || healthy {
+		t.Errorf("new target healthy after %d intervals without a scrape: %+v", staleIntervals, targets)
+	}
+}
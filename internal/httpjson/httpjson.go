@@ -0,0 +1,20 @@
+// Package httpjson writes JSON responses for the HTTP endpoints.
+package httpjson
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Write writes v as the JSON response.
+func Write(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Error writes err as a JSON error response with the given status code.
+func Error(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,26 @@
+package quota
+
+import (
+	"context"
+
+	"go.rikki.moe/v2stat/notify"
+)
+
+// CommandAction runs a command with the event in V2STAT_* environment
+// variables.
+type CommandAction struct {
+	Argv []string
+}
+
+func (a *CommandAction) Run(ctx context.Context, e Event) error {
+	return notify.Command(ctx, a.Argv, e.Env())
+}
+
+// WebhookAction posts the event as JSON to a URL.
+type WebhookAction struct {
+	URL string
+}
+
+func (a *WebhookAction) Run(ctx context.Context, e Event) error {
+	return notify.Webhook(ctx, a.URL, e)
+}
@@ -0,0 +1,253 @@
+// Package quota tracks per-user traffic against the limits of their plans.
+package quota
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.rikki.moe/v2stat/internal/atomicfile"
+	"go.rikki.moe/v2stat/stats"
+)
+
+// actionTimeout bounds the run time of a single action.
+const actionTimeout = time.Minute
+
+// Level is the kind of limit a user crossed.
+type Level string
+
+const (
+	Soft Level = "soft"
+	Hard Level = "hard"
+)
+
+// Limit is the traffic allowed to a user per billing period, in bytes. Zero
+// means no limit.
+type Limit struct {
+	Soft int64
+	Hard int64
+}
+
+// Event describes a user crossing a limit.
+type Event struct {
+	Email       string    `json:"email"`
+	Level       Level     `json:"level"`
+	Usage       int64     `json:"usage"`
+	Limit       int64     `json:"limit"`
+	PeriodStart time.Time `json:"period_start"`
+	Time        time.Time `json:"time"`
+}
+
+// Env returns the event as environment variables for commands.
+func (e Event) Env() map[string]string {
+	return map[string]string{
+		"V2STAT_EMAIL":        e.Email,
+		"V2STAT_LEVEL":        string(e.Level),
+		"V2STAT_USAGE":        strconv.FormatInt(e.Usage, 10),
+		"V2STAT_LIMIT":        strconv.FormatInt(e.Limit, 10),
+		"V2STAT_PERIOD_START": e.PeriodStart.Format(time.RFC3339),
+	}
+}
+
+// Action is run when a user crosses a limit.
+type Action interface {
+	Run(ctx context.Context, e Event) error
+}
+
+// Hook runs Action for events of Level, or of any level if Level is empty.
+type Hook struct {
+	Level  Level
+	Action Action
+}
+
+// Options configures a Quota.
+type Options struct {
+	// StatePath is the file usage is persisted to.
+	StatePath string
+	// ResetDay is the day of the month billing periods start on, 1 to 28.
+	ResetDay int
+	// Location is the time zone periods are computed in.
+	Location *time.Location
+	// Limits of individual users by email.
+	Limits map[string]Limit
+	// Default applies to users not in Limits.
+	Default Limit
+	Hooks   []Hook
+	Logger  logrus.FieldLogger
+}
+
+type state struct {
+	PeriodStart time.Time        `json:"period_start"`
+	Usage       map[string]int64 `json:"usage"`
+	// Notified is the highest level each user was notified about in the
+	// current period.
+	Notified map[string]Level `json:"notified"`
+}
+
+// Quota accumulates the traffic of each user over the billing period and
+// runs the configured actions when a user crosses a limit. It is fed with
+// batches like a sink.
+type Quota struct {
+	opts Options
+
+	mu    sync.Mutex
+	state state
+
+	wg sync.WaitGroup
+}
+
+// New creates a Quota, loading the usage of the current period from
+// opts.StatePath if it exists.
+func New(opts Options) (*Quota, error) {
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	q := &Quota{opts: opts}
+	data, err := os.ReadFile(opts.StatePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &q.state); err != nil {
+			return nil, err
+		}
+	}
+	q.rollover(&q.state, time.Now())
+	return q, nil
+}
+
+// PeriodStart returns the start of the billing period containing t.
+func PeriodStart(t time.Time, resetDay int, loc *time.Location) time.Time {
+	t = t.In(loc)
+	start := time.Date(t.Year(), t.Month(), resetDay, 0, 0, 0, 0, loc)
+	if start.After(t) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// rollover starts a new period in s if t is past the current one.
+func (q *Quota) rollover(s *state, t time.Time) {
+	start := PeriodStart(t, q.opts.ResetDay, q.opts.Location)
+	if start.After(s.PeriodStart) {
+		if !s.PeriodStart.IsZero() {
+			q.opts.Logger.Infof("Starting new billing period at %s", start.Format(time.DateOnly))
+		}
+		*s = state{PeriodStart: start}
+	}
+	if s.Usage == nil {
+		s.Usage = make(map[string]int64)
+	}
+	if s.Notified == nil {
+		s.Notified = make(map[string]Level)
+	}
+}
+
+func (s state) clone() state {
+	s.Usage = maps.Clone(s.Usage)
+	s.Notified = maps.Clone(s.Notified)
+	return s
+}
+
+func (q *Quota) limit(email string) Limit {
+	if l, ok := q.opts.Limits[email]; ok {
+		return l
+	}
+	return q.opts.Default
+}
+
+// Write adds the user traffic of the batch to the usage and runs the actions
+// for users crossing a limit. If the usage cannot be saved, it is left as it
+// was, so the batch can be written again.
+func (q *Quota) Write(ctx context.Context, b *stats.Batch) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	next := q.state.clone()
+	q.rollover(&next, b.Time)
+	if b.Time.Before(next.PeriodStart) {
+		return nil
+	}
+	var events []Event
+	for _, s := range b.Stats {
+		name, ok := stats.ParseName(s.Name)
+		if !ok || name.Kind != stats.KindUser {
+			continue
+		}
+		email := name.Target
+		next.Usage[email] += s.Value
+
+		usage, limit := next.Usage[email], q.limit(email)
+		e := Event{
+			Email:       email,
+			Usage:       usage,
+			PeriodStart: next.PeriodStart,
+			Time:        b.Time,
+		}
+		switch notified := next.Notified[email]; {
+		case limit.Hard > 0 && usage >= limit.Hard && notified != Hard:
+			e.Level, e.Limit = Hard, limit.Hard
+		case limit.Soft > 0 && usage >= limit.Soft && notified == "":
+			e.Level, e.Limit = Soft, limit.Soft
+		default:
+			continue
+		}
+		next.Notified[email] = e.Level
+		events = append(events, e)
+	}
+	if err := q.save(next); err != nil {
+		return err
+	}
+	q.state = next
+	for _, e := range events {
+		q.fire(e)
+	}
+	return nil
+}
+
+// fire runs the actions for e in the background.
+func (q *Quota) fire(e Event) {
+	q.opts.Logger.Warnf("User %s crossed the %s limit: %s of %s", e.Email, e.Level,
+		stats.FormatBytes(e.Usage), stats.FormatBytes(e.Limit))
+	for _, h := range q.opts.Hooks {
+		if h.Level != "" && h.Level != e.Level {
+			continue
+		}
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), actionTimeout)
+			defer cancel()
+			if err := h.Action.Run(ctx, e); err != nil {
+				q.opts.Logger.Errorf("Quota action for %s failed: %v", e.Email, err)
+			}
+		}()
+	}
+}
+
+func (q *Quota) save(s state) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(&s); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(q.opts.StatePath, buf.Bytes())
+}
+
+// Flush is a no-op, usage is saved on every write.
+func (q *Quota) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close waits for running actions to finish.
+func (q *Quota) Close() error {
+	q.wg.Wait()
+	return nil
+}
@@ -0,0 +1,174 @@
+package quota
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+type recordingAction struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (a *recordingAction) Run(ctx context.Context, e Event) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events = append(a.events, e)
+	return nil
+}
+
+func newTestQuota(t *testing.T, path string, action Action) *Quota {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	q, err := New(Options{
+		StatePath: path,
+		ResetDay:  1,
+		Location:  time.UTC,
+		Default:   Limit{Soft: 1000, Hard: 2000},
+		Hooks:     []Hook{{Action: action}},
+		Logger:    logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func userBatch(t time.Time, email string, value int64) *stats.Batch {
+	return &stats.Batch{Time: t, Server: "s", Stats: []stats.Stat{
+		{Name: stats.KindUser + stats.Separator + email + stats.Separator + "traffic" + stats.Separator + stats.DirectionUplink, Value: value},
+		{Name: "inbound>>>vmess>>>traffic>>>uplink", Value: value},
+	}}
+}
+
+func TestPeriodStart(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	tests := []struct {
+		t        time.Time
+		resetDay int
+		want     time.Time
+	}{
+		{time.Date(2025, 4, 15, 12, 0, 0, 0, loc), 1, time.Date(2025, 4, 1, 0, 0, 0, 0, loc)},
+		{time.Date(2025, 4, 15, 12, 0, 0, 0, loc), 20, time.Date(2025, 3, 20, 0, 0, 0, 0, loc)},
+		{time.Date(2025, 4, 20, 0, 0, 0, 0, loc), 20, time.Date(2025, 4, 20, 0, 0, 0, 0, loc)},
+		{time.Date(2025, 1, 5, 0, 0, 0, 0, loc), 10, time.Date(2024, 12, 10, 0, 0, 0, 0, loc)},
+		// Midnight of the reset day in loc is still the previous day in UTC.
+		{time.Date(2025, 4, 30, 17, 0, 0, 0, time.UTC), 1, time.Date(2025, 5, 1, 0, 0, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		if got := PeriodStart(tt.t, tt.resetDay, loc); !got.Equal(tt.want) {
+			t.Errorf("PeriodStart(%s, %d) = %s, want %s", tt.t, tt.resetDay, got, tt.want)
+		}
+	}
+}
+
+func TestQuotaHooksFireOncePerLevel(t *testing.T) {
+	action := &recordingAction{}
+	q := newTestQuota(t, filepath.Join(t.TempDir(), "quota.json"), action)
+	now := time.Now()
+	for _, v := range []int64{600, 600, 600, 600, 600} {
+		if err := q.Write(context.Background(), userBatch(now, "alice@x", v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Close()
+	if len(action.events) != 2 {
+		t.Fatalf("got %d events, want 2: %+v", len(action.events), action.events)
+	}
+	// Hooks run concurrently, so the events may arrive in either order.
+	sort.Slice(action.events, func(i, j int) bool { return action.events[i].Usage < action.events[j].Usage })
+	if e := action.events[0]; e.Level != Soft || e.Usage != 1200 || e.Limit != 1000 {
+		t.Errorf("first event = %+v, want soft at 1200 of 1000", e)
+	}
+	if e := action.events[1]; e.Level != Hard || e.Usage != 2400 || e.Limit != 2000 {
+		t.Errorf("second event = %+v, want hard at 2400 of 2000", e)
+	}
+}
+
+func TestQuotaRolloverAndPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	action := &recordingAction{}
+	q := newTestQuota(t, path, action)
+	now := time.Now()
+	if err := q.Write(context.Background(), userBatch(now, "alice@x", 1500)); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	// Usage and notifications survive a restart.
+	q = newTestQuota(t, path, action)
+	if got := q.state.Usage["alice@x"]; got != 1500 {
+		t.Errorf("usage after reload = %d, want 1500", got)
+	}
+	if got := q.state.Notified["alice@x"]; got != Soft {
+		t.Errorf("notified after reload = %q, want soft", got)
+	}
+
+	// A batch of the next period starts over.
+	next := PeriodStart(now, 1, time.UTC).AddDate(0, 1, 0)
+	if err := q.Write(context.Background(), userBatch(next, "alice@x", 100)); err != nil {
+		t.Fatal(err)
+	}
+	if !q.state.PeriodStart.Equal(next) {
+		t.Errorf("period start = %s, want %s", q.state.PeriodStart, next)
+	}
+	if got := q.state.Usage["alice@x"]; got != 100 {
+		t.Errorf("usage in new period = %d, want 100", got)
+	}
+	if got := q.state.Notified["alice@x"]; got != "" {
+		t.Errorf("notified in new period = %q, want none", got)
+	}
+
+	// Late batches of the previous period are ignored.
+	if err := q.Write(context.Background(), userBatch(now, "alice@x", 5000)); err != nil {
+		t.Fatal(err)
+	}
+	if got := q.state.Usage["alice@x"]; got != 100 {
+		t.Errorf("usage after late batch = %d, want 100", got)
+	}
+	q.Close()
+}
+
+func TestQuotaFailedSaveLeavesUsage(t *testing.T) {
+	// The directory of the state file does not exist yet, so saving fails.
+	dir := filepath.Join(t.TempDir(), "state")
+	action := &recordingAction{}
+	q := newTestQuota(t, filepath.Join(dir, "quota.json"), action)
+	now := time.Now()
+	if err := q.Write(context.Background(), userBatch(now, "alice@x", 1500)); err == nil {
+		t.Fatal("write succeeded without a state directory")
+	}
+	q.Close()
+	if got := q.state.Usage["alice@x"]; got != 0 {
+		t.Errorf("usage after failed write = %d, want 0", got)
+	}
+	if len(action.events) != 0 {
+		t.Errorf("got events after failed write: %+v", action.events)
+	}
+
+	// The batch is written again once the state can be saved.
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Write(context.Background(), userBatch(now, "alice@x", 1500)); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+	if got := q.state.Usage["alice@x"]; got != 1500 {
+		t.Errorf("usage after retry = %d, want 1500", got)
+	}
+	if len(action.events) != 1 || action.events[0].Level != Soft {
+		t.Errorf("events after retry = %+v, want one soft event", action.events)
+	}
+}
@@ -0,0 +1,103 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+// Influx writes stats to InfluxDB.
+type Influx struct {
+	client influxdb2.Client
+	api    api.WriteAPIBlocking
+}
+
+// NewInflux creates a sink writing to the given InfluxDB bucket.
+func NewInflux(url, token, org, bucket string) *Influx {
+	client := influxdb2.NewClient(url, token)
+	return &Influx{
+		client: client,
+		api:    client.WriteAPIBlocking(org, bucket),
+	}
+}
+
+// Write writes the batch in a single request, stats as points of the
+// v2ray_stats measurement and the runtime state as a point of the v2ray_sys
+// measurement.
+func (s *Influx) Write(ctx context.Context, b *stats.Batch) error {
+	points := make([]*write.Point, 0, len(b.Stats)+1)
+	for _, stat := range b.Stats {
+		name, _ := stats.ParseName(stat.Name)
+		tags := name.Tags()
+		tags["server"] = b.Server
+		points = append(points, influxdb2.NewPoint(
+			"v2ray_stats",
+			tags,
+			map[string]interface{}{"value": stat.Value},
+			b.Time,
+		))
+	}
+	if b.Sys != nil {
+		points = append(points, influxdb2.NewPoint(
+			"v2ray_sys",
+			map[string]string{"server": b.Server},
+			map[string]interface{}{
+				"goroutines":     int64(b.Sys.NumGoroutine),
+				"gc_count":       int64(b.Sys.NumGC),
+				"alloc":          int64(b.Sys.Alloc),
+				"total_alloc":    int64(b.Sys.TotalAlloc),
+				"sys":            int64(b.Sys.Sys),
+				"mallocs":        int64(b.Sys.Mallocs),
+				"frees":          int64(b.Sys.Frees),
+				"live_objects":   int64(b.Sys.LiveObjects),
+				"pause_total_ns": int64(b.Sys.PauseTotalNs),
+				"uptime":         int64(b.Sys.Uptime),
+				"restarted":      b.Sys.Restarted,
+			},
+			b.Time,
+		))
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	err := s.api.WritePoint(ctx, points...)
+	if rejected(err) {
+		return fmt.Errorf("%w: %w", ErrRejected, err)
+	}
+	return err
+}
+
+// rejected reports whether InfluxDB refused the points themselves, such as
+// for a field type conflict, rather than the request. Authentication, a
+// missing bucket and rate limiting may be resolved later.
+func rejected(err error) bool {
+	var herr *influxhttp.Error
+	if !errors.As(err, &herr) || herr.StatusCode < 400 || herr.StatusCode >= 500 {
+		return false
+	}
+	switch herr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return true
+}
+
+// Flush flushes points buffered by the client.
+func (s *Influx) Flush(ctx context.Context) error {
+	return s.api.Flush(ctx)
+}
+
+// Close closes the InfluxDB client.
+func (s *Influx) Close() error {
+	s.client.Close()
+	return nil
+}
@@ -0,0 +1,166 @@
+package sink
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+var (
+	trafficDescs = map[string]*prometheus.Desc{
+		stats.KindUser: prometheus.NewDesc(
+			"v2ray_user_traffic_bytes_total",
+			"Traffic of a V2Ray user in bytes.",
+			[]string{"server", "user", "direction"}, nil,
+		),
+		stats.KindInbound: prometheus.NewDesc(
+			"v2ray_inbound_traffic_bytes_total",
+			"Traffic of a V2Ray inbound in bytes.",
+			[]string{"server", "tag", "direction"}, nil,
+		),
+		stats.KindOutbound: prometheus.NewDesc(
+			"v2ray_outbound_traffic_bytes_total",
+			"Traffic of a V2Ray outbound in bytes.",
+			[]string{"server", "tag", "direction"}, nil,
+		),
+	}
+	statDesc = prometheus.NewDesc(
+		"v2ray_stat_total",
+		"V2Ray counter not matching a known name shape.",
+		[]string{"server", "name"}, nil,
+	)
+)
+
+type sysGauge struct {
+	desc  *prometheus.Desc
+	value func(*stats.SysStats) float64
+}
+
+func newSysGauge(name, help string, value func(*stats.SysStats) float64) sysGauge {
+	return sysGauge{
+		desc:  prometheus.NewDesc("v2ray_sys_"+name, help, []string{"server"}, nil),
+		value: value,
+	}
+}
+
+var sysGauges = []sysGauge{
+	newSysGauge("goroutines", "Number of goroutines in the V2Ray process.",
+		func(s *stats.SysStats) float64 { return float64(s.NumGoroutine) }),
+	newSysGauge("gc_count", "Number of completed GC cycles.",
+		func(s *stats.SysStats) float64 { return float64(s.NumGC) }),
+	newSysGauge("alloc_bytes", "Bytes of allocated heap objects.",
+		func(s *stats.SysStats) float64 { return float64(s.Alloc) }),
+	newSysGauge("total_alloc_bytes", "Cumulative bytes allocated for heap objects.",
+		func(s *stats.SysStats) float64 { return float64(s.TotalAlloc) }),
+	newSysGauge("sys_bytes", "Bytes of memory obtained from the OS.",
+		func(s *stats.SysStats) float64 { return float64(s.Sys) }),
+	newSysGauge("mallocs", "Cumulative count of heap objects allocated.",
+		func(s *stats.SysStats) float64 { return float64(s.Mallocs) }),
+	newSysGauge("frees", "Cumulative count of heap objects freed.",
+		func(s *stats.SysStats) float64 { return float64(s.Frees) }),
+	newSysGauge("live_objects", "Number of live heap objects.",
+		func(s *stats.SysStats) float64 { return float64(s.LiveObjects) }),
+	newSysGauge("gc_pause_seconds", "Cumulative time spent in GC stop-the-world pauses.",
+		func(s *stats.SysStats) float64 { return float64(s.PauseTotalNs) / 1e9 }),
+	newSysGauge("uptime_seconds", "Uptime of the V2Ray process.",
+		func(s *stats.SysStats) float64 { return float64(s.Uptime) }),
+}
+
+type counterKey struct {
+	server string
+	name   string
+}
+
+// Prometheus accumulates the traffic of each batch into counters and exposes
+// them along with the latest runtime state of each server for scraping.
+// Counters start from zero whenever v2stat is restarted.
+type Prometheus struct {
+	mu       sync.Mutex
+	counters map[counterKey]int64
+	sys      map[string]*stats.SysStats
+
+	registry *prometheus.Registry
+	handler  http.Handler
+}
+
+// NewPrometheus creates a Prometheus exporter.
+func NewPrometheus() *Prometheus {
+	p := &Prometheus{
+		counters: make(map[counterKey]int64),
+		sys:      make(map[string]*stats.SysStats),
+	}
+	p.registry = prometheus.NewRegistry()
+	p.registry.MustRegister(p)
+	p.handler = promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{})
+	return p
+}
+
+// Register adds metrics served along with the stats, e.g. about v2stat
+// itself.
+func (p *Prometheus) Register(c prometheus.Collector) error {
+	return p.registry.Register(c)
+}
+
+// Handler returns the handler serving the metrics.
+func (p *Prometheus) Handler() http.Handler {
+	return p.handler
+}
+
+// Write adds the batch to the counters.
+func (p *Prometheus) Write(ctx context.Context, b *stats.Batch) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range b.Stats {
+		p.counters[counterKey{server: b.Server, name: s.Name}] += s.Value
+	}
+	if b.Sys != nil {
+		p.sys[b.Server] = b.Sys
+	}
+	return nil
+}
+
+// Flush is a no-op.
+func (p *Prometheus) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close is a no-op.
+func (p *Prometheus) Close() error {
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (p *Prometheus) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range trafficDescs {
+		ch <- d
+	}
+	ch <- statDesc
+	for _, g := range sysGauges {
+		ch <- g.desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (p *Prometheus) Collect(ch chan<- prometheus.Metric) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, v := range p.counters {
+		name, ok := stats.ParseName(k.name)
+		if ok && name.Metric == "traffic" {
+			ch <- prometheus.MustNewConstMetric(trafficDescs[name.Kind], prometheus.CounterValue,
+				float64(v), k.server, name.Target, name.Direction)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(statDesc, prometheus.CounterValue, float64(v), k.server, k.name)
+	}
+	for server, s := range p.sys {
+		for _, g := range sysGauges {
+			ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, g.value(s), server)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package sink
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+func TestPrometheusAccumulatesBatches(t *testing.T) {
+	p := NewPrometheus()
+	batches := []*stats.Batch{
+		{Time: time.Unix(1_700_000_000, 0), Server: "s1", Stats: []stats.Stat{
+			{Name: "user>>>alice@x>>>traffic>>>uplink", Value: 100},
+			{Name: "inbound>>>vmess>>>traffic>>>downlink", Value: 300},
+			{Name: "outbound>>>direct>>>traffic>>>uplink", Value: 5},
+			{Name: "odd>>>name", Value: 1},
+		}, Sys: &stats.SysStats{NumGoroutine: 10, PauseTotalNs: 5e8, Uptime: 60}},
+		{Time: time.Unix(1_700_000_060, 0), Server: "s1", Stats: []stats.Stat{
+			{Name: "user>>>alice@x>>>traffic>>>uplink", Value: 50},
+			{Name: "odd>>>name", Value: 2},
+		}, Sys: &stats.SysStats{NumGoroutine: 12, PauseTotalNs: 1e9, Uptime: 120}},
+		{Time: time.Unix(1_700_000_060, 0), Server: "s2", Stats: []stats.Stat{
+			{Name: "user>>>alice@x>>>traffic>>>uplink", Value: 7},
+		}},
+	}
+	for _, b := range batches {
+		if err := p.Write(context.Background(), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := `
+# HELP v2ray_inbound_traffic_bytes_total Traffic of a V2Ray inbound in bytes.
+# TYPE v2ray_inbound_traffic_bytes_total counter
+v2ray_inbound_traffic_bytes_total{direction="downlink",server="s1",tag="vmess"} 300
+# HELP v2ray_outbound_traffic_bytes_total Traffic of a V2Ray outbound in bytes.
+# TYPE v2ray_outbound_traffic_bytes_total counter
+v2ray_outbound_traffic_bytes_total{direction="uplink",server="s1",tag="direct"} 5
+# HELP v2ray_stat_total V2Ray counter not matching a known name shape.
+# TYPE v2ray_stat_total counter
+v2ray_stat_total{name="odd>>>name",server="s1"} 3
+# HELP v2ray_sys_gc_pause_seconds Cumulative time spent in GC stop-the-world pauses.
+# TYPE v2ray_sys_gc_pause_seconds gauge
+v2ray_sys_gc_pause_seconds{server="s1"} 1
+# HELP v2ray_sys_goroutines Number of goroutines in the V2Ray process.
+# TYPE v2ray_sys_goroutines gauge
+v2ray_sys_goroutines{server="s1"} 12
+# HELP v2ray_sys_uptime_seconds Uptime of the V2Ray process.
+# TYPE v2ray_sys_uptime_seconds gauge
+v2ray_sys_uptime_seconds{server="s1"} 120
+# HELP v2ray_user_traffic_bytes_total Traffic of a V2Ray user in bytes.
+# TYPE v2ray_user_traffic_bytes_total counter
+v2ray_user_traffic_bytes_total{direction="uplink",server="s1",user="alice@x"} 150
+v2ray_user_traffic_bytes_total{direction="uplink",server="s2",user="alice@x"} 7
+`
+	err := testutil.CollectAndCompare(p, strings.NewReader(want),
+		"v2ray_user_traffic_bytes_total",
+		"v2ray_inbound_traffic_bytes_total",
+		"v2ray_outbound_traffic_bytes_total",
+		"v2ray_stat_total",
+		"v2ray_sys_goroutines",
+		"v2ray_sys_gc_pause_seconds",
+		"v2ray_sys_uptime_seconds",
+	)
+	if err != nil {
+		t.Error(err)
+	}
+	// Every gauge is reported for the server with runtime state only.
+	if n := testutil.CollectAndCount(p, "v2ray_sys_alloc_bytes"); n != 1 {
+		t.Errorf("got %d v2ray_sys_alloc_bytes series, want 1", n)
+	}
+}
@@ -0,0 +1,139 @@
+// Package sink defines the destinations collected stats are written to.
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+// ErrRejected is wrapped by write errors of batches the destination will
+// never accept, e.g. because of malformed points, so retrying them is futile.
+var ErrRejected = errors.New("batch rejected")
+
+// Sink is a destination for collected stats.
+type Sink interface {
+	// Write writes a batch of stats.
+	Write(ctx context.Context, b *stats.Batch) error
+	// Flush writes out any data buffered by the sink.
+	Flush(ctx context.Context) error
+	// Close releases the resources held by the sink. It does not flush, callers
+	// Flush first if buffered data should be written out.
+	Close() error
+}
+
+type namedSink struct {
+	name string
+	Sink
+}
+
+// Multi fans batches out to several sinks. Sinks may be added and replaced
+// while batches are written.
+type Multi struct {
+	mu    sync.RWMutex
+	sinks []namedSink
+	// Observe is called with the result of every write to a sink if set.
+	Observe func(name string, b *stats.Batch, err error)
+}
+
+// Add adds a sink under the given name, which is used in error messages.
+func (m *Multi) Add(name string, s Sink) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sinks = append(m.sinks, namedSink{name: name, Sink: s})
+}
+
+// Replace replaces the sink of the given name, if any, with the sink
+// returned by open, or removes it if open is nil, and returns the old sink
+// for the caller to close. Nothing is changed if open fails. No batches are
+// written in the meantime.
+func (m *Multi) Replace(name string, open func() (Sink, error)) (Sink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var s Sink
+	if open != nil {
+		var err error
+		if s, err = open(); err != nil {
+			return nil, err
+		}
+	}
+	i := slices.IndexFunc(m.sinks, func(s namedSink) bool { return s.name == name })
+	if i < 0 {
+		if s != nil {
+			m.sinks = append(m.sinks, namedSink{name: name, Sink: s})
+		}
+		return nil, nil
+	}
+	old := m.sinks[i].Sink
+	if s != nil {
+		m.sinks[i] = namedSink{name: name, Sink: s}
+	} else {
+		m.sinks = slices.Delete(m.sinks, i, i+1)
+	}
+	return old, nil
+}
+
+// Get returns the sink of the given name, nil if there is none.
+func (m *Multi) Get(name string) Sink {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.sinks {
+		if s.name == name {
+			return s.Sink
+		}
+	}
+	return nil
+}
+
+// WriteEach writes to every sink the batch returned by batch for its name,
+// and reports the result of every write to done if it is not nil. A failing
+// sink does not prevent the batch from being written to the others.
+func (m *Multi) WriteEach(ctx context.Context, batch func(name string) *stats.Batch, done func(name string, err error)) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var errs []error
+	for _, s := range m.sinks {
+		b := batch(s.name)
+		err := s.Write(ctx, b)
+		if m.Observe != nil {
+			m.Observe(s.name, b, err)
+		}
+		if done != nil {
+			done(s.name, err)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Flush flushes every sink.
+func (m *Multi) Flush(ctx context.Context) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var errs []error
+	for _, s := range m.sinks {
+		if err := s.Flush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every sink.
+func (m *Multi) Close() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var errs []error
+	for _, s := range m.sinks {
+		if err := s.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
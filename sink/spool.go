@@ -0,0 +1,291 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.rikki.moe/v2stat/internal/atomicfile"
+	"go.rikki.moe/v2stat/stats"
+)
+
+const (
+	spoolExt          = ".json"
+	spoolWriteTimeout = 30 * time.Second
+	spoolMinBackoff   = time.Second
+	spoolMaxBackoff   = 5 * time.Minute
+)
+
+// Spool is a write-ahead queue in front of another sink. Batches are first
+// persisted to a directory, one file per batch, and then written to the
+// underlying sink in order by a background worker. Batches the sink fails to
+// accept stay on disk, survive restarts and are retried with backoff, unless
+// the sink rejects them for good.
+type Spool struct {
+	dir    string
+	max    int
+	next   Sink
+	logger logrus.FieldLogger
+
+	mu       sync.Mutex // guards the directory listing and nextSeq
+	nextSeq  uint64
+	dropped  int64
+	rejected int64
+
+	// draining is a semaphore serializing writes to next that can be given
+	// up on when the context is done.
+	draining chan struct{}
+
+	notify chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewSpool creates a spool in dir in front of next. If max is positive, at
+// most max batches are retained and the oldest are dropped beyond that.
+// Batches left in dir by a previous run are replayed first.
+func NewSpool(dir string, max int, next Sink, logger logrus.FieldLogger) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		dir:      dir,
+		max:      max,
+		next:     next,
+		logger:   logger,
+		notify:   make(chan struct{}, 1),
+		draining: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	seqs, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	if len(seqs) > 0 {
+		s.nextSeq = seqs[len(seqs)-1] + 1
+		logger.Infof("Replaying %d spooled batches from %s", len(seqs), dir)
+		s.notify <- struct{}{}
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// list returns the sequence numbers of the spooled batches in order.
+func (s *Spool) list() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, spoolExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolExt))
+}
+
+// Depth returns the number of batches waiting to be written.
+func (s *Spool) Depth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seqs, _ := s.list()
+	return len(seqs)
+}
+
+// Dropped returns the number of batches dropped because the spool was full.
+func (s *Spool) Dropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Rejected returns the number of batches set aside because the underlying
+// sink rejected them.
+func (s *Spool) Rejected() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rejected
+}
+
+// Write persists the batch and schedules it to be written to the underlying
+// sink. It returns once the batch is safely on disk.
+func (s *Spool) Write(ctx context.Context, b *stats.Batch) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	seq := s.nextSeq
+	s.nextSeq++
+	err = atomicfile.WriteFile(s.path(seq), data)
+	if err == nil && s.max > 0 {
+		s.trim()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("spool batch: %w", err)
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// trim drops the oldest batches beyond the limit. s.mu must be held.
+func (s *Spool) trim() {
+	seqs, err := s.list()
+	if err != nil || len(seqs) <= s.max {
+		return
+	}
+	drop := seqs[:len(seqs)-s.max]
+	for _, seq := range drop {
+		if err := os.Remove(s.path(seq)); err != nil {
+			s.logger.Errorf("Failed to drop spooled batch: %v", err)
+			continue
+		}
+		s.dropped++
+	}
+	s.logger.Warnf("Spool %s is full, dropped %d oldest batches", s.dir, len(drop))
+}
+
+// drain writes spooled batches to the underlying sink in order until the
+// spool is empty or a write fails. It waits for a drain in progress, at
+// most until ctx is done. Every write is bounded by spoolWriteTimeout and
+// the deadline of ctx, whichever comes first.
+func (s *Spool) drain(ctx context.Context) error {
+	select {
+	case s.draining <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-s.draining }()
+	for {
+		s.mu.Lock()
+		seqs, err := s.list()
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if len(seqs) == 0 {
+			return nil
+		}
+		path := s.path(seqs[0])
+
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			// Dropped by trim in the meantime.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var b stats.Batch
+		if err := json.Unmarshal(data, &b); err != nil {
+			// A corrupt entry would block the queue forever, set it aside.
+			s.logger.Errorf("Discarding corrupt spooled batch %s: %v", path, err)
+			if err := os.Rename(path, path+".corrupt"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		wctx, cancel := context.WithTimeout(ctx, spoolWriteTimeout)
+		err = s.next.Write(wctx, &b)
+		cancel()
+		if errors.Is(err, ErrRejected) {
+			// Like a corrupt entry, it would block the queue forever.
+			s.logger.Errorf("Discarding spooled batch %s rejected by the sink: %v", path, err)
+			if err := os.Rename(path, path+".rejected"); err != nil {
+				return err
+			}
+			s.mu.Lock()
+			s.rejected++
+			s.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+}
+
+func (s *Spool) run() {
+	defer s.wg.Done()
+	backoff := spoolMinBackoff
+	retry := time.NewTimer(0)
+	<-retry.C
+	for {
+		select {
+		case <-s.done:
+			retry.Stop()
+			return
+		case <-s.notify:
+		case <-retry.C:
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-s.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := s.drain(ctx)
+		cancel()
+		if err == nil {
+			backoff = spoolMinBackoff
+			continue
+		}
+
+		s.logger.Errorf("Failed to write spooled batches, retrying in %s: %v", backoff, err)
+		retry.Stop()
+		retry.Reset(backoff)
+		backoff = min(backoff*2, spoolMaxBackoff)
+	}
+}
+
+// Flush writes all spooled batches to the underlying sink and flushes it.
+func (s *Spool) Flush(ctx context.Context) error {
+	if err := s.drain(ctx); err != nil {
+		return err
+	}
+	return s.next.Flush(ctx)
+}
+
+// Close stops the background worker and closes the underlying sink.
+// Batches not written yet stay on disk.
+func (s *Spool) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return s.next.Close()
+}
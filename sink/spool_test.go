@@ -0,0 +1,191 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+// recordingSink records the times of the batches written to it, failing
+// while fail is set and rejecting batches of time reject.
+type recordingSink struct {
+	mu     sync.Mutex
+	fail   bool
+	reject int64
+	times  []int64
+}
+
+func (r *recordingSink) setFail(fail bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fail = fail
+}
+
+func (r *recordingSink) Write(ctx context.Context, b *stats.Batch) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail {
+		return errors.New("unavailable")
+	}
+	if r.reject != 0 && b.Time.Unix() == r.reject {
+		return fmt.Errorf("%w: field type conflict", ErrRejected)
+	}
+	r.times = append(r.times, b.Time.Unix())
+	return nil
+}
+
+func (r *recordingSink) Flush(ctx context.Context) error { return nil }
+func (r *recordingSink) Close() error                    { return nil }
+
+func testLogger() logrus.FieldLogger {
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	return l
+}
+
+func writeBatches(t *testing.T, s *Spool, times ...int64) {
+	t.Helper()
+	for _, ts := range times {
+		if err := s.Write(context.Background(), &stats.Batch{Time: time.Unix(ts, 0), Server: "s"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkTimes(t *testing.T, r *recordingSink, want ...int64) {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.times) != len(want) {
+		t.Fatalf("written batches = %v, want %v", r.times, want)
+	}
+	for i := range want {
+		if r.times[i] != want[i] {
+			t.Fatalf("written batches = %v, want %v", r.times, want)
+		}
+	}
+}
+
+func TestSpoolKeepsOrderAcrossFailures(t *testing.T) {
+	next := &recordingSink{fail: true}
+	s, err := NewSpool(t.TempDir(), 0, next, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	writeBatches(t, s, 1, 2, 3)
+	if err := s.Flush(context.Background()); err == nil {
+		t.Fatal("Flush() succeeded while the sink fails")
+	}
+	if d := s.Depth(); d != 3 {
+		t.Errorf("Depth() = %d, want 3", d)
+	}
+	next.setFail(false)
+	writeBatches(t, s, 4)
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkTimes(t, next, 1, 2, 3, 4)
+	if d := s.Depth(); d != 0 {
+		t.Errorf("Depth() = %d after flush, want 0", d)
+	}
+}
+
+func TestSpoolReplaysAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	failing := &recordingSink{fail: true}
+	s, err := NewSpool(dir, 0, failing, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeBatches(t, s, 1, 2)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	next := &recordingSink{}
+	s, err = NewSpool(dir, 0, next, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	writeBatches(t, s, 3)
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkTimes(t, next, 1, 2, 3)
+}
+
+func TestSpoolDropsOldestWhenFull(t *testing.T) {
+	next := &recordingSink{fail: true}
+	s, err := NewSpool(t.TempDir(), 2, next, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	writeBatches(t, s, 1, 2, 3, 4)
+	if d := s.Dropped(); d != 2 {
+		t.Errorf("Dropped() = %d, want 2", d)
+	}
+	next.setFail(false)
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkTimes(t, next, 3, 4)
+}
+
+func TestSpoolSetsAsideRejectedBatches(t *testing.T) {
+	dir := t.TempDir()
+	next := &recordingSink{reject: 2}
+	s, err := NewSpool(dir, 0, next, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	writeBatches(t, s, 1, 2, 3)
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkTimes(t, next, 1, 3)
+	if d := s.Rejected(); d != 1 {
+		t.Errorf("Rejected() = %d, want 1", d)
+	}
+	if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%020d%s.rejected", 1, spoolExt))); err != nil {
+		t.Errorf("rejected batch not set aside: %v", err)
+	}
+}
+
+func TestSpoolFlushRespectsDeadlineWhileDraining(t *testing.T) {
+	next := &recordingSink{}
+	s, err := NewSpool(t.TempDir(), 0, next, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// A background drain is stuck writing.
+	s.draining <- struct{}{}
+	defer func() { <-s.draining }()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Flush() = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Flush() took %s past its deadline", elapsed)
+	}
+}
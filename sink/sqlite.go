@@ -0,0 +1,95 @@
+package sink
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.rikki.moe/v2stat/stats"
+	"go.rikki.moe/v2stat/store"
+)
+
+// rollupInterval is how often the SQLite sink rolls up and prunes samples.
+const rollupInterval = 10 * time.Minute
+
+// SQLite writes stats to the local SQLite database. A background worker
+// rolls the samples up into hourly, daily and monthly totals and deletes
+// those past their retention.
+type SQLite struct {
+	db     *store.DB
+	logger logrus.FieldLogger
+
+	mu   sync.Mutex // guards keep
+	keep store.Retention
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewSQLite creates a sink writing to the database at path, keeping samples
+// as long as keep allows.
+func NewSQLite(path string, keep store.Retention, logger logrus.FieldLogger) (*SQLite, error) {
+	db, err := store.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &SQLite{
+		db:     db,
+		logger: logger,
+		keep:   keep,
+		done:   make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// DB returns the underlying database, e.g. to read stats back.
+func (s *SQLite) DB() *store.DB {
+	return s.db
+}
+
+// SetRetention changes how long samples are kept.
+func (s *SQLite) SetRetention(keep store.Retention) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keep = keep
+}
+
+func (s *SQLite) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(rollupInterval)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		keep := s.keep
+		s.mu.Unlock()
+		if err := s.db.Rollup(context.Background(), time.Now(), keep); err != nil {
+			s.logger.Errorf("Failed to roll up samples: %v", err)
+		}
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Write stores the batch in a single transaction.
+func (s *SQLite) Write(ctx context.Context, b *stats.Batch) error {
+	return s.db.WriteBatch(ctx, b)
+}
+
+// Flush is a no-op, writes are committed immediately.
+func (s *SQLite) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close stops the rollups and closes the database.
+func (s *SQLite) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return s.db.Close()
+}
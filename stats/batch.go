@@ -0,0 +1,36 @@
+package stats
+
+import (
+	"time"
+
+	"go.rikki.moe/v2stat/command"
+)
+
+// Stat is a single counter value reported by V2Ray.
+type Stat struct {
+	Name  string `json:"name"`
+	Value int64  `json:"value"`
+}
+
+// Batch is the set of stats collected from one server in a single scrape.
+// Stat values are the traffic since the previous scrape.
+type Batch struct {
+	Time   time.Time `json:"time"`
+	Server string    `json:"server"`
+	Stats  []Stat    `json:"stats"`
+	// Sys is nil if the runtime state could not be queried.
+	Sys *SysStats `json:"sys,omitempty"`
+}
+
+// NewBatch creates a batch from the stats returned by QueryStats.
+func NewBatch(t time.Time, server string, stats []*command.Stat) *Batch {
+	b := &Batch{
+		Time:   t,
+		Server: server,
+		Stats:  make([]Stat, 0, len(stats)),
+	}
+	for _, s := range stats {
+		b.Stats = append(b.Stats, Stat{Name: s.Name, Value: s.Value})
+	}
+	return b
+}
@@ -0,0 +1,84 @@
+package stats
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Filter selects stats by name. A name is selected if it matches any of the
+// include patterns, or there are none, and matches none of the exclude
+// patterns. Patterns are substrings, or regular expressions if Regexp is set.
+type Filter struct {
+	Include []string
+	Exclude []string
+	Regexp  bool
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// NewFilter creates a filter, compiling the patterns if they are regular
+// expressions.
+func NewFilter(include, exclude []string, isRegexp bool) (*Filter, error) {
+	f := &Filter{Include: include, Exclude: exclude, Regexp: isRegexp}
+	if !isRegexp {
+		return f, nil
+	}
+	var err error
+	if f.include, err = compile(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compile(exclude); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func compile(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// Match reports whether the filter selects name.
+func (f *Filter) Match(name string) bool {
+	if len(f.Include) > 0 && !f.matchAny(f.Include, f.include, name) {
+		return false
+	}
+	return !f.matchAny(f.Exclude, f.exclude, name)
+}
+
+func (f *Filter) matchAny(patterns []string, res []*regexp.Regexp, name string) bool {
+	if f.Regexp {
+		for _, re := range res {
+			if re.MatchString(name) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, p := range patterns {
+		if strings.Contains(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply returns the stats selected by the filter.
+func (f *Filter) Apply(stats []Stat) []Stat {
+	out := stats[:0]
+	for _, s := range stats {
+		if f.Match(s.Name) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,66 @@
+package stats
+
+import "testing"
+
+func TestFilterMatch(t *testing.T) {
+	const (
+		alice = "user>>>alice@x>>>traffic>>>uplink"
+		bob   = "user>>>bob@x>>>traffic>>>downlink"
+		api   = "inbound>>>api>>>traffic>>>uplink"
+	)
+	tests := []struct {
+		name             string
+		include, exclude []string
+		regexp           bool
+		want             map[string]bool
+	}{
+		{"empty", nil, nil, false, map[string]bool{alice: true, bob: true, api: true}},
+		{"include", []string{"user>>>"}, nil, false, map[string]bool{alice: true, bob: true, api: false}},
+		{"any include", []string{"alice", "api"}, nil, false, map[string]bool{alice: true, bob: false, api: true}},
+		{"exclude", nil, []string{">>>api>>>"}, false, map[string]bool{alice: true, bob: true, api: false}},
+		{"exclude wins", []string{"user>>>"}, []string{"bob"}, false, map[string]bool{alice: true, bob: false, api: false}},
+		// Substrings are matched literally.
+		{"substring", []string{"user>>>.*>>>uplink"}, nil, false, map[string]bool{alice: false, bob: false, api: false}},
+		{"regexp", []string{"^user>>>.*>>>uplink$"}, nil, true, map[string]bool{alice: true, bob: false, api: false}},
+		{"regexp exclude", nil, []string{"^inbound"}, true, map[string]bool{alice: true, bob: true, api: false}},
+	}
+	for _, tt := range tests {
+		f, err := NewFilter(tt.include, tt.exclude, tt.regexp)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for name, want := range tt.want {
+			if got := f.Match(name); got != want {
+				t.Errorf("%s: Match(%q) = %v, want %v", tt.name, name, got, want)
+			}
+		}
+	}
+}
+
+func TestFilterInvalidRegexp(t *testing.T) {
+	if _, err := NewFilter([]string{"("}, nil, true); err == nil {
+		t.Error("invalid include accepted")
+	}
+	if _, err := NewFilter(nil, []string{"["}, true); err == nil {
+		t.Error("invalid exclude accepted")
+	}
+	// Substrings are not compiled.
+	if _, err := NewFilter([]string{"("}, nil, false); err != nil {
+		t.Errorf("substring rejected: %v", err)
+	}
+}
+
+func TestFilterApply(t *testing.T) {
+	f, err := NewFilter([]string{"user>>>"}, []string{"bob"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := f.Apply([]Stat{
+		{Name: "user>>>alice@x>>>traffic>>>uplink", Value: 1},
+		{Name: "user>>>bob@x>>>traffic>>>uplink", Value: 2},
+		{Name: "inbound>>>api>>>traffic>>>uplink", Value: 3},
+	})
+	if len(got) != 1 || got[0].Value != 1 {
+		t.Errorf("Apply = %+v, want alice only", got)
+	}
+}
@@ -0,0 +1,72 @@
+package stats
+
+import "strings"
+
+// Separator is the delimiter V2Ray uses between the components of a stat name.
+const Separator = ">>>"
+
+// Known kinds of V2Ray traffic counters.
+const (
+	KindUser     = "user"
+	KindInbound  = "inbound"
+	KindOutbound = "outbound"
+)
+
+// Known traffic directions.
+const (
+	DirectionUplink   = "uplink"
+	DirectionDownlink = "downlink"
+)
+
+// Name is a V2Ray stat name split into its components, e.g.
+// "user>>>alice@x>>>traffic>>>uplink".
+type Name struct {
+	Raw       string
+	Kind      string // user, inbound or outbound
+	Target    string // user email or inbound/outbound tag
+	Metric    string // e.g. traffic
+	Direction string // uplink or downlink
+}
+
+// ParseName splits a stat name into its components. The second return value
+// is false if the name does not have a known shape, in which case only Raw is
+// set.
+func ParseName(raw string) (Name, bool) {
+	name := Name{Raw: raw}
+	parts := strings.Split(raw, Separator)
+	if len(parts) != 4 {
+		return name, false
+	}
+	switch parts[0] {
+	case KindUser, KindInbound, KindOutbound:
+	default:
+		return name, false
+	}
+	switch parts[3] {
+	case DirectionUplink, DirectionDownlink:
+	default:
+		return name, false
+	}
+	if parts[1] == "" || parts[2] == "" {
+		return name, false
+	}
+	name.Kind = parts[0]
+	name.Target = parts[1]
+	name.Metric = parts[2]
+	name.Direction = parts[3]
+	return name, true
+}
+
+// Tags returns the name as a set of tags. Names of unknown shape fall back to
+// a single "stat" tag holding the raw name.
+func (n Name) Tags() map[string]string {
+	if n.Kind == "" {
+		return map[string]string{"stat": n.Raw}
+	}
+	return map[string]string{
+		"kind":      n.Kind,
+		"target":    n.Target,
+		"metric":    n.Metric,
+		"direction": n.Direction,
+	}
+}
@@ -0,0 +1,48 @@
+package stats
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want Name
+		ok   bool
+	}{
+		{"user>>>alice@x>>>traffic>>>uplink", Name{Kind: KindUser, Target: "alice@x", Metric: "traffic", Direction: DirectionUplink}, true},
+		{"inbound>>>vmess-in>>>traffic>>>downlink", Name{Kind: KindInbound, Target: "vmess-in", Metric: "traffic", Direction: DirectionDownlink}, true},
+		{"outbound>>>direct>>>traffic>>>uplink", Name{Kind: KindOutbound, Target: "direct", Metric: "traffic", Direction: DirectionUplink}, true},
+		// Targets may contain anything but the separator.
+		{"user>>>a b>c@x>>>traffic>>>uplink", Name{Kind: KindUser, Target: "a b>c@x", Metric: "traffic", Direction: DirectionUplink}, true},
+		{"balancer>>>b>>>traffic>>>uplink", Name{}, false},
+		{"User>>>alice@x>>>traffic>>>uplink", Name{}, false},
+		{"user>>>alice@x>>>traffic>>>sideways", Name{}, false},
+		{"user>>>alice@x>>>traffic>>>Uplink", Name{}, false},
+		{"user>>>alice@x>>>traffic", Name{}, false},
+		{"user>>>alice@x>>>traffic>>>uplink>>>extra", Name{}, false},
+		{"user>>>>>>traffic>>>uplink", Name{}, false},
+		{"user>>>alice@x>>>>>>uplink", Name{}, false},
+		{"user>>>alice@x>>>traffic>>>", Name{}, false},
+		{"uptime", Name{}, false},
+		{"", Name{}, false},
+	}
+	for _, tt := range tests {
+		tt.want.Raw = tt.raw
+		got, ok := ParseName(tt.raw)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("ParseName(%q) = %+v, %v, want %+v, %v", tt.raw, got, ok, tt.want, tt.ok)
+		}
+
+		var want map[string]string
+		if tt.ok {
+			want = map[string]string{"kind": tt.want.Kind, "target": tt.want.Target, "metric": tt.want.Metric, "direction": tt.want.Direction}
+		} else {
+			want = map[string]string{"stat": tt.raw}
+		}
+		if tags := got.Tags(); !reflect.DeepEqual(tags, want) {
+			t.Errorf("ParseName(%q).Tags() = %v, want %v", tt.raw, tags, want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package stats
+
+import "go.rikki.moe/v2stat/command"
+
+// SysStats is the runtime state of the V2Ray process as reported by
+// GetSysStats.
+type SysStats struct {
+	NumGoroutine uint32 `json:"num_goroutine"`
+	NumGC        uint32 `json:"num_gc"`
+	Alloc        uint64 `json:"alloc"`
+	TotalAlloc   uint64 `json:"total_alloc"`
+	Sys          uint64 `json:"sys"`
+	Mallocs      uint64 `json:"mallocs"`
+	Frees        uint64 `json:"frees"`
+	LiveObjects  uint64 `json:"live_objects"`
+	PauseTotalNs uint64 `json:"pause_total_ns"`
+	Uptime       uint32 `json:"uptime"`
+	// Restarted is set if V2Ray was restarted since the previous scrape.
+	Restarted bool `json:"restarted,omitempty"`
+}
+
+// NewSysStats converts a GetSysStats response.
+func NewSysStats(r *command.SysStatsResponse) *SysStats {
+	return &SysStats{
+		NumGoroutine: r.NumGoroutine,
+		NumGC:        r.NumGC,
+		Alloc:        r.Alloc,
+		TotalAlloc:   r.TotalAlloc,
+		Sys:          r.Sys,
+		Mallocs:      r.Mallocs,
+		Frees:        r.Frees,
+		LiveObjects:  r.LiveObjects,
+		PauseTotalNs: r.PauseTotalNs,
+		Uptime:       r.Uptime,
+	}
+}
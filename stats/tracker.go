@@ -0,0 +1,103 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"go.rikki.moe/v2stat/internal/atomicfile"
+)
+
+// uptimeSlack is how far the reported uptime may fall behind the uptime
+// expected from the wall clock before V2Ray is considered restarted.
+const uptimeSlack = 30 * time.Second
+
+// Counters is a snapshot of the cumulative counters of a V2Ray server.
+type Counters struct {
+	Time time.Time `json:"time"`
+	// Uptime is zero if the runtime state was not available.
+	Uptime uint32           `json:"uptime"`
+	Values map[string]int64 `json:"values"`
+}
+
+// Tracker turns cumulative counters, as returned by QueryStats without
+// reset, into the traffic since the previous scrape. The last committed
+// snapshot is persisted so deltas stay correct across v2stat restarts.
+type Tracker struct {
+	path     string
+	interval time.Duration
+	last     *Counters
+}
+
+// LoadTracker creates a tracker persisting its state to path, loading the
+// state of a previous run if the file exists. interval is the time between
+// scrapes.
+func LoadTracker(path string, interval time.Duration) (*Tracker, error) {
+	t := &Tracker{path: path, interval: interval}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var last Counters
+	if err := json.Unmarshal(data, &last); err != nil {
+		return nil, err
+	}
+	t.last = &last
+	return t, nil
+}
+
+// Delta computes the traffic since the last committed snapshot. Counters
+// that went backwards, or all counters if V2Ray was restarted, are counted
+// from zero. Without a committed snapshot, the counters are only counted if
+// V2Ray was started within the last interval; otherwise they hold traffic
+// from before v2stat ran and cur merely becomes the baseline. It returns the
+// stats to record, the snapshot to commit once they are written, and whether
+// a restart was detected.
+func (t *Tracker) Delta(cur *Counters) ([]Stat, *Counters, bool) {
+	if t.last == nil && (cur.Uptime == 0 || time.Duration(cur.Uptime)*time.Second >= t.interval) {
+		return []Stat{}, cur, false
+	}
+	restarted := t.last != nil && t.restarted(cur)
+	delta := make([]Stat, 0, len(cur.Values))
+	for name, value := range cur.Values {
+		prev, ok := int64(0), false
+		if t.last != nil && !restarted {
+			prev, ok = t.last.Values[name]
+		}
+		if !ok || value < prev {
+			prev = 0
+		}
+		delta = append(delta, Stat{Name: name, Value: value - prev})
+	}
+	return delta, cur, restarted
+}
+
+func (t *Tracker) restarted(cur *Counters) bool {
+	if cur.Uptime == 0 || t.last.Uptime == 0 {
+		return false
+	}
+	elapsed := cur.Time.Sub(t.last.Time)
+	expected := time.Duration(t.last.Uptime)*time.Second + elapsed
+	return time.Duration(cur.Uptime)*time.Second < expected-uptimeSlack
+}
+
+// Commit makes c the snapshot the next delta is computed against and
+// persists it.
+func (t *Tracker) Commit(c *Counters) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(t.path, buf.Bytes()); err != nil {
+		return err
+	}
+	t.last = c
+	return nil
+}
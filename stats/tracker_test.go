@@ -0,0 +1,92 @@
+package stats
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func counters(t time.Time, uptime uint32, values map[string]int64) *Counters {
+	return &Counters{Time: t, Uptime: uptime, Values: values}
+}
+
+func sum(stats []Stat) map[string]int64 {
+	out := make(map[string]int64, len(stats))
+	for _, s := range stats {
+		out[s.Name] += s.Value
+	}
+	return out
+}
+
+func TestTrackerFirstSnapshotIsBaseline(t *testing.T) {
+	tr, err := LoadTracker(filepath.Join(t.TempDir(), "state.json"), 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	// V2Ray has been up for a day, its counters predate v2stat.
+	delta, snap, restarted := tr.Delta(counters(now, 86400, map[string]int64{"a": 1 << 30}))
+	if len(delta) != 0 || restarted {
+		t.Fatalf("Delta() = %v, %v, want no stats", delta, restarted)
+	}
+	if err := tr.Commit(snap); err != nil {
+		t.Fatal(err)
+	}
+	delta, _, _ = tr.Delta(counters(now.Add(5*time.Minute), 86700, map[string]int64{"a": 1<<30 + 500}))
+	if got := sum(delta)["a"]; got != 500 {
+		t.Errorf("delta after baseline = %d, want 500", got)
+	}
+}
+
+func TestTrackerFirstSnapshotOfFreshV2Ray(t *testing.T) {
+	tr, err := LoadTracker(filepath.Join(t.TempDir(), "state.json"), 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta, _, _ := tr.Delta(counters(time.Unix(1_700_000_000, 0), 120, map[string]int64{"a": 700}))
+	if got := sum(delta)["a"]; got != 700 {
+		t.Errorf("delta of V2Ray started within the interval = %d, want 700", got)
+	}
+}
+
+func TestTrackerRestartsAndResets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	tr, err := LoadTracker(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	_, snap, _ := tr.Delta(counters(now, 3600, map[string]int64{"a": 1000, "b": 1000}))
+	if err := tr.Commit(snap); err != nil {
+		t.Fatal(err)
+	}
+
+	// The state survives a restart of v2stat.
+	tr, err = LoadTracker(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b went backwards without a V2Ray restart, e.g. reset by someone else.
+	delta, snap, restarted := tr.Delta(counters(now.Add(time.Minute), 3660, map[string]int64{"a": 1100, "b": 40, "c": 5}))
+	if restarted {
+		t.Error("restart detected without one")
+	}
+	want := map[string]int64{"a": 100, "b": 40, "c": 5}
+	for name, v := range want {
+		if got := sum(delta)[name]; got != v {
+			t.Errorf("delta of %s = %d, want %d", name, got, v)
+		}
+	}
+	if err := tr.Commit(snap); err != nil {
+		t.Fatal(err)
+	}
+
+	// V2Ray restarted, counters start from zero again.
+	delta, _, restarted = tr.Delta(counters(now.Add(2*time.Minute), 30, map[string]int64{"a": 2000, "b": 10}))
+	if !restarted {
+		t.Error("restart not detected")
+	}
+	if got := sum(delta); got["a"] != 2000 || got["b"] != 10 {
+		t.Errorf("delta after restart = %v, want a=2000 b=10", got)
+	}
+}
@@ -0,0 +1,94 @@
+package stats
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Usage is the traffic of a user, inbound or outbound.
+type Usage struct {
+	Kind     string `json:"kind"`
+	Target   string `json:"target"`
+	Uplink   int64  `json:"uplink"`
+	Downlink int64  `json:"downlink"`
+}
+
+// Total returns the traffic in both directions.
+func (u Usage) Total() int64 {
+	return u.Uplink + u.Downlink
+}
+
+// MarshalJSON encodes the usage along with its total.
+func (u Usage) MarshalJSON() ([]byte, error) {
+	type usage Usage
+	return json.Marshal(struct {
+		usage
+		Total int64 `json:"total"`
+	}{usage(u), u.Total()})
+}
+
+// Traffic is the traffic in both directions and its total.
+type Traffic struct {
+	Uplink   int64 `json:"uplink"`
+	Downlink int64 `json:"downlink"`
+	Total    int64 `json:"total"`
+}
+
+// Traffic returns the traffic of u without its kind and target.
+func (u Usage) Traffic() Traffic {
+	return Traffic{Uplink: u.Uplink, Downlink: u.Downlink, Total: u.Total()}
+}
+
+// Aggregate sums traffic counters by kind and target. Names of unknown shape
+// are skipped. The result is sorted by kind, then by total traffic in
+// descending order.
+func Aggregate(stats []Stat) []Usage {
+	type key struct{ kind, target string }
+	byKey := make(map[key]*Usage)
+	var usage []*Usage
+	for _, s := range stats {
+		name, ok := ParseName(s.Name)
+		if !ok {
+			continue
+		}
+		k := key{name.Kind, name.Target}
+		u, ok := byKey[k]
+		if !ok {
+			u = &Usage{Kind: name.Kind, Target: name.Target}
+			byKey[k] = u
+			usage = append(usage, u)
+		}
+		switch name.Direction {
+		case DirectionUplink:
+			u.Uplink += s.Value
+		case DirectionDownlink:
+			u.Downlink += s.Value
+		}
+	}
+
+	out := make([]Usage, len(usage))
+	for i, u := range usage {
+		out[i] = *u
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Kind != out[j].Kind {
+			return kindOrder(out[i].Kind) < kindOrder(out[j].Kind)
+		}
+		if out[i].Total() != out[j].Total() {
+			return out[i].Total() > out[j].Total()
+		}
+		return out[i].Target < out[j].Target
+	})
+	return out
+}
+
+func kindOrder(kind string) int {
+	switch kind {
+	case KindUser:
+		return 0
+	case KindInbound:
+		return 1
+	default:
+		return 2
+	}
+}
@@ -0,0 +1,25 @@
+package stats
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUsageJSON(t *testing.T) {
+	u := Usage{Kind: KindUser, Target: "alice@x", Uplink: 1, Downlink: 2}
+	data, err := json.Marshal([]Usage{u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"kind":"user","target":"alice@x","uplink":1,"downlink":2,"total":3}]`
+	if string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+	data, err = json.Marshal(u.Traffic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"uplink":1,"downlink":2,"total":3}`; string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+}
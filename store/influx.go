@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+// Influx reads stats written by the InfluxDB sink.
+type Influx struct {
+	client influxdb2.Client
+	org    string
+	bucket string
+}
+
+// OpenInflux creates a reader for the given InfluxDB bucket.
+func OpenInflux(url, token, org, bucket string) *Influx {
+	return &Influx{
+		client: influxdb2.NewClient(url, token),
+		org:    org,
+		bucket: bucket,
+	}
+}
+
+// Totals returns the sum of every counter within [from, to), optionally
+// restricted to a single server.
+func (i *Influx) Totals(ctx context.Context, from, to time.Time, server string) ([]stats.Stat, error) {
+	var filter strings.Builder
+	filter.WriteString(`r._measurement == "v2ray_stats" and r._field == "value"`)
+	if server != "" {
+		fmt.Fprintf(&filter, ` and r.server == %q`, server)
+	}
+	query := fmt.Sprintf(`from(bucket: %q)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => %s)
+  |> group(columns: ["kind", "target", "metric", "direction", "stat"])
+  |> sum()`,
+		i.bucket, from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339), filter.String())
+
+	result, err := i.client.QueryAPI(i.org).Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	var totals []stats.Stat
+	for result.Next() {
+		r := result.Record()
+		value, ok := r.Value().(int64)
+		if !ok {
+			continue
+		}
+		totals = append(totals, stats.Stat{Name: statName(r.Values()), Value: value})
+	}
+	return totals, result.Err()
+}
+
+// statName rebuilds the stat name from the tags written by the sink.
+func statName(tags map[string]interface{}) string {
+	tag := func(k string) string {
+		s, _ := tags[k].(string)
+		return s
+	}
+	if raw := tag("stat"); raw != "" {
+		return raw
+	}
+	return strings.Join([]string{tag("kind"), tag("target"), tag("metric"), tag("direction")}, stats.Separator)
+}
+
+// Close closes the InfluxDB client.
+func (i *Influx) Close() error {
+	i.client.Close()
+	return nil
+}
@@ -0,0 +1,177 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+// Totals returns the sum of every counter within [from, to), optionally
+// restricted to a single server, ordered by name. Periods within the range
+// that are rolled up are read from the rollups.
+func (d *DB) Totals(ctx context.Context, from, to time.Time, server string) ([]stats.Stat, error) {
+	spans, err := d.plan(ctx, from, to, func(resolution) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]int64)
+	for _, sp := range spans {
+		where, args := sp.where()
+		query := "SELECT name, SUM(value) FROM " + sp.table() + " WHERE " + where
+		if server != "" {
+			query += " AND server = ?"
+			args = append(args, server)
+		}
+		query += " GROUP BY name"
+		rows, err := d.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var name string
+			var value int64
+			if err := rows.Scan(&name, &value); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			sums[name] += value
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	totals := make([]stats.Stat, 0, len(sums))
+	for name, value := range sums {
+		totals = append(totals, stats.Stat{Name: name, Value: value})
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Name < totals[j].Name })
+	return totals, nil
+}
+
+// prefixRange returns the bounds [lo, hi) of the strings starting with
+// prefix, so prefix matches can use the name index. The prefix must not end
+// with the maximum byte value.
+func prefixRange(prefix string) (string, string) {
+	hi := []byte(prefix)
+	hi[len(hi)-1]++
+	return prefix, string(hi)
+}
+
+// Point is the sum of a counter within a time bucket.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Name  string    `json:"name"`
+	Value int64     `json:"value"`
+}
+
+// Series returns the counters with names starting with prefix, summed into
+// buckets of step within [from, to) and ordered by time. Buckets are
+// aligned to multiples of step since the Unix epoch. An empty prefix or
+// server matches every counter or server. Rollups are used where their
+// periods fit into the buckets.
+func (d *DB) Series(ctx context.Context, from, to time.Time, step time.Duration, prefix, server string) ([]Point, error) {
+	secs := int64(step / time.Second)
+	if secs <= 0 {
+		secs = 1
+	}
+	spans, err := d.plan(ctx, from, to, func(r resolution) bool {
+		return r.length > 0 && secs%int64(r.length/time.Second) == 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	type key struct {
+		ts   int64
+		name string
+	}
+	sums := make(map[key]int64)
+	for _, sp := range spans {
+		where, args := sp.where()
+		query := "SELECT ts / ? * ? AS bucket, name, SUM(value) FROM " + sp.table() + " WHERE " + where
+		args = append([]interface{}{secs, secs}, args...)
+		if prefix != "" {
+			lo, hi := prefixRange(prefix)
+			query += " AND name >= ? AND name < ?"
+			args = append(args, lo, hi)
+		}
+		if server != "" {
+			query += " AND server = ?"
+			args = append(args, server)
+		}
+		query += " GROUP BY bucket, name"
+		rows, err := d.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var k key
+			var value int64
+			if err := rows.Scan(&k.ts, &k.name, &value); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			sums[k] += value
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	points := make([]Point, 0, len(sums))
+	for k, value := range sums {
+		points = append(points, Point{Time: time.Unix(k.ts, 0), Name: k.name, Value: value})
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if !points[i].Time.Equal(points[j].Time) {
+			return points[i].Time.Before(points[j].Time)
+		}
+		return points[i].Name < points[j].Name
+	})
+	return points, nil
+}
+
+// SysPoint is the runtime state of a server at a point in time.
+type SysPoint struct {
+	Time   time.Time `json:"time"`
+	Server string    `json:"server"`
+	stats.SysStats
+}
+
+// SysSeries returns the runtime state samples within [from, to), ordered
+// by time. An empty server matches every server.
+func (d *DB) SysSeries(ctx context.Context, from, to time.Time, server string) ([]SysPoint, error) {
+	query := `SELECT ts, server, num_goroutine, num_gc, alloc, total_alloc, sys, mallocs, frees,
+		live_objects, pause_total_ns, uptime, restarted
+		FROM sys_samples WHERE ts >= ? AND ts < ?`
+	args := []interface{}{from.Unix(), to.Unix()}
+	if server != "" {
+		query += " AND server = ?"
+		args = append(args, server)
+	}
+	query += " ORDER BY ts, server"
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var points []SysPoint
+	for rows.Next() {
+		var p SysPoint
+		var ts int64
+		var alloc, totalAlloc, sys, mallocs, frees, liveObjects, pauseTotalNs int64
+		err := rows.Scan(&ts, &p.Server, &p.NumGoroutine, &p.NumGC, &alloc, &totalAlloc, &sys,
+			&mallocs, &frees, &liveObjects, &pauseTotalNs, &p.Uptime, &p.Restarted)
+		if err != nil {
+			return nil, err
+		}
+		p.Time = time.Unix(ts, 0)
+		p.Alloc, p.TotalAlloc, p.Sys = uint64(alloc), uint64(totalAlloc), uint64(sys)
+		p.Mallocs, p.Frees = uint64(mallocs), uint64(frees)
+		p.LiveObjects, p.PauseTotalNs = uint64(liveObjects), uint64(pauseTotalNs)
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
@@ -0,0 +1,16 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+// Reader reads collected traffic back from a storage backend.
+type Reader interface {
+	// Totals returns the sum of every counter within [from, to), optionally
+	// restricted to a single server.
+	Totals(ctx context.Context, from, to time.Time, server string) ([]stats.Stat, error)
+	Close() error
+}
@@ -0,0 +1,311 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"time"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+// rollupGrace is how long after the end of an hour it is rolled up, so most
+// samples written late are included. Samples written after that are added
+// to the rollups by WriteBatch.
+const rollupGrace = 10 * time.Minute
+
+// resolution is a period samples are rolled up into. Periods are aligned in
+// UTC, so they line up with each other and with reports in any time zone
+// with a whole-hour offset.
+type resolution struct {
+	name string
+	// length is the length of every period, 0 if it varies.
+	length time.Duration
+	// start returns the start of the period containing t, and next the
+	// start of the period after the one starting at t.
+	start func(t time.Time) time.Time
+	next  func(t time.Time) time.Time
+}
+
+// resolutions are ordered from fine to coarse, each rolled up from the one
+// before.
+var resolutions = []resolution{
+	{
+		name:   "hour",
+		length: time.Hour,
+		start:  func(t time.Time) time.Time { return t.UTC().Truncate(time.Hour) },
+		next:   func(t time.Time) time.Time { return t.UTC().Add(time.Hour) },
+	},
+	{
+		name:   "day",
+		length: 24 * time.Hour,
+		start: func(t time.Time) time.Time {
+			t = t.UTC()
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		},
+		next: func(t time.Time) time.Time { return t.UTC().AddDate(0, 0, 1) },
+	},
+	{
+		name: "month",
+		start: func(t time.Time) time.Time {
+			t = t.UTC()
+			return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		},
+		next: func(t time.Time) time.Time { return t.UTC().AddDate(0, 1, 0) },
+	},
+}
+
+// Retention is how long samples are kept at each resolution, 0 to keep them
+// forever. Samples are never deleted before they are rolled up into the
+// next resolution.
+type Retention struct {
+	Raw     time.Duration
+	Hourly  time.Duration
+	Daily   time.Duration
+	Monthly time.Duration
+}
+
+// rollupState returns the time every resolution is rolled up until.
+func (d *DB) rollupState(ctx context.Context) (map[string]time.Time, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT resolution, done_until FROM rollup_state")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	state := make(map[string]time.Time)
+	for rows.Next() {
+		var name string
+		var until int64
+		if err := rows.Scan(&name, &until); err != nil {
+			return nil, err
+		}
+		state[name] = time.Unix(until, 0).UTC()
+	}
+	return state, rows.Err()
+}
+
+// Rollup sums the samples of every hour that ended by now into hourly totals
+// per server and counter, hourly totals of complete days into daily ones and
+// daily totals of complete months into monthly ones. It then deletes the
+// samples older than keep allows.
+func (d *DB) Rollup(ctx context.Context, now time.Time, keep Retention) error {
+	state, err := d.rollupState(ctx)
+	if err != nil {
+		return err
+	}
+	limit := now.Add(-rollupGrace)
+	for i, r := range resolutions {
+		source := ""
+		if i > 0 {
+			// Periods are rolled up from the finer resolution once it covers
+			// them completely.
+			source = resolutions[i-1].name
+			limit = state[source]
+		}
+		until, err := d.rollup(ctx, r, source, state[r.name], limit)
+		if err != nil {
+			return err
+		}
+		state[r.name] = until
+	}
+	return d.prune(ctx, now, keep, state)
+}
+
+// rollup sums the periods of r from until to limit from the rollups of
+// source, or from the raw samples if it is empty, and returns the time r is
+// rolled up until afterwards.
+func (d *DB) rollup(ctx context.Context, r resolution, source string, until, limit time.Time) (time.Time, error) {
+	if limit.IsZero() {
+		return until, nil
+	}
+	query := "SELECT MIN(ts) FROM samples"
+	insert := `INSERT OR REPLACE INTO rollups (resolution, ts, server, name, value)
+		SELECT ?, ?, server, name, SUM(value) FROM samples
+		WHERE ts >= ? AND ts < ? GROUP BY server, name`
+	var args []interface{}
+	if source != "" {
+		query = "SELECT MIN(ts) FROM rollups WHERE resolution = ?"
+		insert = `INSERT OR REPLACE INTO rollups (resolution, ts, server, name, value)
+			SELECT ?, ?, server, name, SUM(value) FROM rollups
+			WHERE ts >= ? AND ts < ? AND resolution = ? GROUP BY server, name`
+		args = append(args, source)
+	}
+	if until.IsZero() {
+		var first sql.NullInt64
+		if err := d.db.QueryRowContext(ctx, query, args...).Scan(&first); err != nil {
+			return until, err
+		}
+		if !first.Valid {
+			return until, nil
+		}
+		until = r.start(time.Unix(first.Int64, 0))
+	}
+	if r.next(until).After(limit) {
+		return until, nil
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return until, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, insert)
+	if err != nil {
+		return until, err
+	}
+	defer stmt.Close()
+	start := until
+	for ; !r.next(start).After(limit); start = r.next(start) {
+		end := r.next(start)
+		if _, err := stmt.ExecContext(ctx, append([]interface{}{r.name, start.Unix(), start.Unix(), end.Unix()}, args...)...); err != nil {
+			return until, err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "INSERT OR REPLACE INTO rollup_state (resolution, done_until) VALUES (?, ?)",
+		r.name, start.Unix())
+	if err != nil {
+		return until, err
+	}
+	if err := tx.Commit(); err != nil {
+		return until, err
+	}
+	return start, nil
+}
+
+// prune deletes the samples older than keep allows that are rolled up into
+// the next resolution already.
+func (d *DB) prune(ctx context.Context, now time.Time, keep Retention, state map[string]time.Time) error {
+	deletes := []struct {
+		query string
+		keep  time.Duration
+		// rolledUp is the time the samples are rolled up until, nil if
+		// they are not rolled up.
+		rolledUp *time.Time
+	}{
+		{"DELETE FROM samples WHERE ts < ?", keep.Raw, ptr(state["hour"])},
+		{"DELETE FROM sys_samples WHERE ts < ?", keep.Raw, nil},
+		{"DELETE FROM rollups WHERE resolution = 'hour' AND ts < ?", keep.Hourly, ptr(state["day"])},
+		{"DELETE FROM rollups WHERE resolution = 'day' AND ts < ?", keep.Daily, ptr(state["month"])},
+		{"DELETE FROM rollups WHERE resolution = 'month' AND ts < ?", keep.Monthly, nil},
+	}
+	for _, del := range deletes {
+		if del.keep <= 0 {
+			continue
+		}
+		cutoff := now.Add(-del.keep)
+		if del.rolledUp != nil && del.rolledUp.Before(cutoff) {
+			cutoff = *del.rolledUp
+		}
+		if _, err := d.db.ExecContext(ctx, del.query, cutoff.Unix()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addLate adds the stats of a batch written after its period was rolled up
+// to the rollups of every resolution covering it already.
+func addLate(ctx context.Context, tx *sql.Tx, b *stats.Batch) error {
+	ts := b.Time.Unix()
+	rows, err := tx.QueryContext(ctx, "SELECT resolution FROM rollup_state WHERE done_until > ?", ts)
+	if err != nil {
+		return err
+	}
+	var late []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		late = append(late, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(late) == 0 {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO rollups (resolution, ts, server, name, value) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (resolution, ts, server, name) DO UPDATE SET value = value + excluded.value`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range resolutions {
+		if !slices.Contains(late, r.name) {
+			continue
+		}
+		start := r.start(b.Time).Unix()
+		for _, s := range b.Stats {
+			if _, err := stmt.ExecContext(ctx, r.name, start, b.Server, s.Name, s.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func ptr(t time.Time) *time.Time {
+	return &t
+}
+
+// span is a time range [from, to) read from the rollups of a resolution, or
+// from the raw samples if res is empty.
+type span struct {
+	res      string
+	from, to time.Time
+}
+
+// where returns the condition selecting the rows of the span from its table.
+func (s span) where() (string, []interface{}) {
+	if s.res == "" {
+		return "ts >= ? AND ts < ?", []interface{}{s.from.Unix(), s.to.Unix()}
+	}
+	return "resolution = ? AND ts >= ? AND ts < ?", []interface{}{s.res, s.from.Unix(), s.to.Unix()}
+}
+
+func (s span) table() string {
+	if s.res == "" {
+		return "samples"
+	}
+	return "rollups"
+}
+
+// plan splits [from, to) into spans to read, using the rollups of the
+// coarsest usable resolution for the periods within the range that are
+// rolled up, and finer ones down to the raw samples for the rest.
+func (d *DB) plan(ctx context.Context, from, to time.Time, usable func(resolution) bool) ([]span, error) {
+	state, err := d.rollupState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return planLevel(from, to, len(resolutions)-1, state, usable), nil
+}
+
+func planLevel(from, to time.Time, level int, state map[string]time.Time, usable func(resolution) bool) []span {
+	if !from.Before(to) {
+		return nil
+	}
+	if level < 0 {
+		return []span{{from: from, to: to}}
+	}
+	r := resolutions[level]
+	until, ok := state[r.name]
+	if !usable(r) || !ok {
+		return planLevel(from, to, level-1, state, usable)
+	}
+	start := r.start(from)
+	if start.Before(from) {
+		start = r.next(start)
+	}
+	end := r.start(to)
+	if until.Before(end) {
+		end = until
+	}
+	if !start.Before(end) {
+		return planLevel(from, to, level-1, state, usable)
+	}
+	spans := planLevel(from, start, level-1, state, usable)
+	spans = append(spans, span{res: r.name, from: start, to: end})
+	return append(spans, planLevel(end, to, level-1, state, usable)...)
+}
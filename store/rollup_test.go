@@ -0,0 +1,249 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+const (
+	userStat    = "user>>>alice@x>>>traffic>>>uplink"
+	inboundStat = "inbound>>>vmess>>>traffic>>>downlink"
+)
+
+func openTest(t *testing.T) *DB {
+	t.Helper()
+	d, err := Open(filepath.Join(t.TempDir(), "v2stat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// inLocal runs the test with time.Local set to a zone with daylight saving
+// time.
+func inLocal(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := time.Local
+	time.Local = loc
+	t.Cleanup(func() { time.Local = saved })
+	return loc
+}
+
+// writeSamples writes a batch with 1 byte of user and 2 bytes of inbound
+// traffic every 5 minutes within [from, to).
+func writeSamples(t *testing.T, d *DB, from, to time.Time) {
+	t.Helper()
+	for ts := from; ts.Before(to); ts = ts.Add(5 * time.Minute) {
+		b := &stats.Batch{Time: ts, Server: "s1", Stats: []stats.Stat{
+			{Name: userStat, Value: 1},
+			{Name: inboundStat, Value: 2},
+		}}
+		if err := d.WriteBatch(context.Background(), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// rawTotal returns the user traffic within [from, to) from the raw samples.
+func rawTotal(t *testing.T, d *DB, from, to time.Time) int64 {
+	t.Helper()
+	var n int64
+	err := d.db.QueryRow("SELECT COALESCE(SUM(value), 0) FROM samples WHERE name = ? AND ts >= ? AND ts < ?",
+		userStat, from.Unix(), to.Unix()).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func userTotal(t *testing.T, d *DB, from, to time.Time) int64 {
+	t.Helper()
+	totals, err := d.Totals(context.Background(), from, to, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range totals {
+		if s.Name == userStat {
+			return s.Value
+		}
+	}
+	return 0
+}
+
+func TestRollupAcrossDSTAndMonthEnd(t *testing.T) {
+	loc := inLocal(t, "America/New_York")
+	d := openTest(t)
+	ctx := context.Background()
+
+	// Daylight saving time ends on November 1, 2026 in New York.
+	from := time.Date(2026, 9, 28, 0, 0, 0, 0, loc)
+	to := time.Date(2026, 11, 4, 0, 0, 0, 0, loc)
+	writeSamples(t, d, from, to)
+	// Rolling up periodically continues from the stored progress.
+	for now := from; now.Before(to.Add(2 * time.Hour)); now = now.Add(5 * time.Hour) {
+		if err := d.Rollup(ctx, now, Retention{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every rollup is stamped with the start of a UTC period.
+	rows, err := d.db.Query("SELECT resolution, ts FROM rollups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var res string
+		var ts int64
+		if err := rows.Scan(&res, &ts); err != nil {
+			t.Fatal(err)
+		}
+		u := time.Unix(ts, 0).UTC()
+		ok := u.Minute() == 0 && u.Second() == 0
+		switch res {
+		case "day":
+			ok = ok && u.Hour() == 0
+		case "month":
+			ok = ok && u.Hour() == 0 && u.Day() == 1
+		}
+		if !ok {
+			t.Errorf("%s rollup stamped %s", res, u)
+		}
+	}
+	rows.Close()
+	state, err := d.rollupState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC); !state["month"].Equal(want) {
+		t.Errorf("months rolled up until %s, want %s", state["month"], want)
+	}
+
+	ranges := [][2]time.Time{
+		// October in local time, reading the month rollup would be wrong.
+		{time.Date(2026, 10, 1, 0, 0, 0, 0, loc), time.Date(2026, 11, 1, 0, 0, 0, 0, loc)},
+		// October in UTC, exactly the month rollup.
+		{time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		// The day of the change, 25 hours long.
+		{time.Date(2026, 11, 1, 0, 0, 0, 0, loc), time.Date(2026, 11, 2, 0, 0, 0, 0, loc)},
+		{from, to},
+		{from.Add(-48 * time.Hour), to.Add(48 * time.Hour)},
+		{time.Date(2026, 10, 7, 13, 17, 0, 0, loc), time.Date(2026, 11, 3, 2, 41, 0, 0, loc)},
+	}
+	for _, r := range ranges {
+		if got, want := userTotal(t, d, r[0], r[1]), rawTotal(t, d, r[0], r[1]); got != want {
+			t.Errorf("Totals(%s, %s) = %d, want %d", r[0], r[1], got, want)
+		}
+	}
+
+	// Daily series read from the day rollups match the raw samples.
+	points, err := d.Series(ctx, from, to, 24*time.Hour, "user>>>", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum int64
+	for _, p := range points {
+		sum += p.Value
+	}
+	if want := rawTotal(t, d, from, to); sum != want {
+		t.Errorf("daily series sums to %d, want %d", sum, want)
+	}
+}
+
+func TestRollupLateSamples(t *testing.T) {
+	d := openTest(t)
+	ctx := context.Background()
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2026, 4, 2, 0, 0, 0, 0, time.UTC)
+	writeSamples(t, d, from, to)
+	if err := d.Rollup(ctx, to, Retention{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A batch of an hour rolled up already, e.g. from a long interval.
+	late := time.Date(2026, 3, 10, 6, 59, 0, 0, time.UTC)
+	b := &stats.Batch{Time: late, Server: "s1", Stats: []stats.Stat{{Name: userStat, Value: 1000}}}
+	if err := d.WriteBatch(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range [][2]time.Time{
+		{from, to},
+		{late.Truncate(time.Hour), late.Truncate(time.Hour).Add(time.Hour)},
+		{time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC), time.Date(2026, 3, 11, 0, 0, 0, 0, time.UTC)},
+	} {
+		if got, want := userTotal(t, d, r[0], r[1]), rawTotal(t, d, r[0], r[1]); got != want {
+			t.Errorf("Totals(%s, %s) = %d, want %d", r[0], r[1], got, want)
+		}
+	}
+}
+
+func TestRollupRetention(t *testing.T) {
+	d := openTest(t)
+	ctx := context.Background()
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC)
+	writeSamples(t, d, from, to)
+	march := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	want := map[[2]time.Time]int64{
+		{from, to}:                      rawTotal(t, d, from, to),
+		{from, march}:                   rawTotal(t, d, from, march),
+		{march, march.AddDate(0, 0, 7)}: rawTotal(t, d, march, march.AddDate(0, 0, 7)),
+	}
+
+	keep := Retention{Raw: 24 * time.Hour, Hourly: 7 * 24 * time.Hour, Daily: 30 * 24 * time.Hour}
+	if err := d.Rollup(ctx, to, keep); err != nil {
+		t.Fatal(err)
+	}
+	var raw int64
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM samples WHERE ts < ?", to.Add(-25*time.Hour).Unix()).Scan(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw != 0 {
+		t.Errorf("%d raw samples past their retention are left", raw)
+	}
+	// Whole months and days are still exact from the rollups.
+	for r, n := range want {
+		if got := userTotal(t, d, r[0], r[1]); got != n {
+			t.Errorf("Totals(%s, %s) = %d after pruning, want %d", r[0], r[1], got, n)
+		}
+	}
+}
+
+func TestPlanCoversRange(t *testing.T) {
+	inLocal(t, "Australia/Adelaide")
+	state := map[string]time.Time{
+		"hour":  time.Date(2026, 4, 20, 13, 0, 0, 0, time.UTC),
+		"day":   time.Date(2026, 4, 20, 0, 0, 0, 0, time.UTC),
+		"month": time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC),
+	}
+	all := func(resolution) bool { return true }
+	for _, r := range [][2]time.Time{
+		{time.Date(2026, 1, 15, 10, 30, 0, 0, time.Local), time.Date(2026, 4, 25, 0, 0, 0, 0, time.Local)},
+		{time.Date(2026, 4, 5, 0, 0, 0, 0, time.Local), time.Date(2026, 4, 6, 0, 0, 0, 0, time.Local)},
+		{time.Date(2026, 4, 20, 14, 0, 0, 0, time.UTC), time.Date(2026, 4, 20, 15, 0, 0, 0, time.UTC)},
+	} {
+		spans := planLevel(r[0], r[1], len(resolutions)-1, state, all)
+		at := r[0]
+		for _, sp := range spans {
+			if !sp.from.Equal(at) || !sp.from.Before(sp.to) {
+				t.Fatalf("plan of %s to %s has gap or overlap at %s: %+v", r[0], r[1], at, spans)
+			}
+			if sp.res != "" && sp.to.After(state[sp.res]) {
+				t.Errorf("span %+v reads past the rollups", sp)
+			}
+			at = sp.to
+		}
+		if !at.Equal(r[1]) {
+			t.Errorf("plan of %s to %s ends at %s: %+v", r[0], r[1], at, spans)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Package store implements the local SQLite storage backend and reading
+// collected stats back from the storage backends.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+// migrations holds the schema changes in order. The schema version of a
+// database is kept in PRAGMA user_version and equals the number of migrations
+// applied to it. Never edit an existing entry, append a new one instead.
+var migrations = []string{
+	`CREATE TABLE samples (
+		id     INTEGER PRIMARY KEY,
+		ts     INTEGER NOT NULL,
+		server TEXT    NOT NULL,
+		name   TEXT    NOT NULL,
+		value  INTEGER NOT NULL
+	);
+	CREATE INDEX samples_ts ON samples (ts);
+	CREATE INDEX samples_name_ts ON samples (name, ts);`,
+	`CREATE TABLE sys_samples (
+		id             INTEGER PRIMARY KEY,
+		ts             INTEGER NOT NULL,
+		server         TEXT    NOT NULL,
+		num_goroutine  INTEGER NOT NULL,
+		num_gc         INTEGER NOT NULL,
+		alloc          INTEGER NOT NULL,
+		total_alloc    INTEGER NOT NULL,
+		sys            INTEGER NOT NULL,
+		mallocs        INTEGER NOT NULL,
+		frees          INTEGER NOT NULL,
+		live_objects   INTEGER NOT NULL,
+		pause_total_ns INTEGER NOT NULL,
+		uptime         INTEGER NOT NULL,
+		restarted      INTEGER NOT NULL
+	);
+	CREATE INDEX sys_samples_server_ts ON sys_samples (server, ts);`,
+	`CREATE TABLE rollups (
+		resolution TEXT    NOT NULL,
+		ts         INTEGER NOT NULL,
+		server     TEXT    NOT NULL,
+		name       TEXT    NOT NULL,
+		value      INTEGER NOT NULL,
+		PRIMARY KEY (resolution, ts, server, name)
+	) WITHOUT ROWID;
+	CREATE TABLE rollup_state (
+		resolution TEXT    PRIMARY KEY,
+		done_until INTEGER NOT NULL
+	);`,
+}
+
+// DB is a SQLite database holding collected samples.
+type DB struct {
+	db *sql.DB
+}
+
+// Open opens the database at path, creating it if needed, and brings its
+// schema up to date.
+func Open(path string) (*DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer only.
+	db.SetMaxOpenConns(1)
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DB{db: db}, nil
+}
+
+// OpenReadOnly opens the existing database at path for reading, e.g. while
+// v2stat writes to it. Its schema must be up to date, it is not migrated.
+func OpenReadOnly(path string) (*DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("read schema version: %w", err)
+	}
+	if version != len(migrations) {
+		db.Close()
+		return nil, fmt.Errorf("database schema version %d does not match supported version %d", version, len(migrations))
+	}
+	return &DB{db: db}, nil
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrate to version %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrate to version %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migrate to version %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// WriteBatch stores all stats of the batch and its runtime state in a single
+// transaction. Stats of periods that are rolled up already are added to the
+// rollups.
+func (d *DB) WriteBatch(ctx context.Context, b *stats.Batch) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO samples (ts, server, name, value) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	ts := b.Time.Unix()
+	for _, s := range b.Stats {
+		if _, err := stmt.ExecContext(ctx, ts, b.Server, s.Name, s.Value); err != nil {
+			return err
+		}
+	}
+	if sys := b.Sys; sys != nil {
+		_, err := tx.ExecContext(ctx, `INSERT INTO sys_samples (
+			ts, server, num_goroutine, num_gc, alloc, total_alloc, sys,
+			mallocs, frees, live_objects, pause_total_ns, uptime, restarted
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			ts, b.Server, sys.NumGoroutine, sys.NumGC, int64(sys.Alloc), int64(sys.TotalAlloc), int64(sys.Sys),
+			int64(sys.Mallocs), int64(sys.Frees), int64(sys.LiveObjects), int64(sys.PauseTotalNs), sys.Uptime, sys.Restarted)
+		if err != nil {
+			return err
+		}
+	}
+	if err := addLate(ctx, tx, b); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close closes the database.
+func (d *DB) Close() error {
+	return d.db.Close()
+}
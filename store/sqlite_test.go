@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.rikki.moe/v2stat/stats"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	dir := t.TempDir()
+
+	// A missing database is not created.
+	missing := filepath.Join(dir, "missing.db")
+	if _, err := OpenReadOnly(missing); err == nil {
+		t.Error("opened a missing database")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("missing database was created: %v", err)
+	}
+
+	// A database of an older version is not migrated.
+	old := filepath.Join(dir, "old.db")
+	db, err := sql.Open("sqlite3", "file:"+old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(migrations[0] + "; PRAGMA user_version = 1"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := OpenReadOnly(old); err == nil {
+		t.Error("opened a database with an old schema")
+	}
+
+	path := filepath.Join(dir, "v2stat.db")
+	d, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	now := time.Now()
+	b := &stats.Batch{Time: now, Server: "s1", Stats: []stats.Stat{{Name: userStat, Value: 1}}}
+	if err := d.WriteBatch(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	totals, err := r.Totals(context.Background(), now.Add(-time.Hour), now.Add(time.Hour), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(totals) != 1 || totals[0].Value != 1 {
+		t.Errorf("totals = %+v, want 1 byte of %s", totals, userStat)
+	}
+	if err := r.WriteBatch(context.Background(), b); err == nil {
+		t.Error("wrote to a read-only database")
+	}
+}
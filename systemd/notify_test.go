@@ -0,0 +1,93 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T, addr string) *net.UnixConn {
+	t.Helper()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if Enabled() {
+		t.Error("enabled without NOTIFY_SOCKET")
+	}
+	if err := Notify("READY=1"); err != nil {
+		t.Errorf("Notify() without NOTIFY_SOCKET = %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn := listen(t, path)
+	t.Setenv("NOTIFY_SOCKET", path)
+	if !Enabled() {
+		t.Error("not enabled with NOTIFY_SOCKET")
+	}
+	if err := Notify("READY=1\nSTATUS=Up"); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, conn); got != "READY=1\nSTATUS=Up" {
+		t.Errorf("got %q", got)
+	}
+
+	// Abstract sockets are given with a leading @.
+	name := "v2stat-test-" + strconv.Itoa(os.Getpid())
+	conn = listen(t, "\x00"+name)
+	t.Setenv("NOTIFY_SOCKET", "@"+name)
+	if err := Notify("WATCHDOG=1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, conn); got != "WATCHDOG=1" {
+		t.Errorf("got %q from abstract socket", got)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing.sock"))
+	if err := Notify("READY=1"); err == nil {
+		t.Error("Notify() to a missing socket succeeded")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"30000000", "", 30 * time.Second},
+		{"30000000", pid, 30 * time.Second},
+		{"30000000", "1", 0},
+		{"0", "", 0},
+		{"-5", "", 0},
+		{"x", "", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("WATCHDOG_USEC", tt.usec)
+		t.Setenv("WATCHDOG_PID", tt.pid)
+		if got := WatchdogInterval(); got != tt.want {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: got %s, want %s", tt.usec, tt.pid, got, tt.want)
+		}
+	}
+}
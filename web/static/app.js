@@ -0,0 +1,134 @@
+"use strict";
+
+const colors = ["#1e88e5", "#e53935", "#43a047", "#fb8c00", "#8e24aa",
+  "#00acc1", "#6d4c41", "#fdd835", "#546e7a", "#d81b60"];
+
+function formatBytes(n) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB", "PiB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return i === 0 ? n + " B" : n.toFixed(2) + " " + units[i];
+}
+
+function formatDuration(s) {
+  const d = Math.floor(s / 86400), h = Math.floor(s % 86400 / 3600),
+    m = Math.floor(s % 3600 / 60);
+  return d > 0 ? `${d}d ${h}h` : h > 0 ? `${h}h ${m}m` : `${m}m ${s % 60}s`;
+}
+
+function el(tag, attrs, text) {
+  const ns = ["svg", "path", "line", "text"].includes(tag)
+    ? "http://www.w3.org/2000/svg" : "http://www.w3.org/1999/xhtml";
+  const e = document.createElementNS(ns, tag);
+  for (const [k, v] of Object.entries(attrs || {})) e.setAttribute(k, v);
+  if (text !== undefined) e.textContent = text;
+  return e;
+}
+
+async function get(path, params) {
+  const q = new URLSearchParams(params);
+  const resp = await fetch(`${path}?${q}`);
+  const body = await resp.json();
+  if (!resp.ok) throw new Error(body.error || resp.statusText);
+  return body;
+}
+
+// chart draws lines of {name, points: [[time, value]]} into container.
+function chart(container, lines, format) {
+  const w = 600, h = 220, left = 70, bottom = 20;
+  container.replaceChildren();
+  const svg = el("svg", {viewBox: `0 0 ${w} ${h}`, preserveAspectRatio: "none"});
+  container.append(svg);
+
+  const all = lines.flatMap(l => l.points);
+  if (all.length === 0) {
+    svg.append(el("text", {x: w / 2, y: h / 2, "text-anchor": "middle"}, "No data"));
+    return;
+  }
+  const t0 = Math.min(...all.map(p => p[0])), t1 = Math.max(...all.map(p => p[0]));
+  const vmax = Math.max(...all.map(p => p[1]), 1);
+  const x = t => left + (t1 === t0 ? 0 : (t - t0) / (t1 - t0) * (w - left - 5));
+  const y = v => 5 + (1 - v / vmax) * (h - bottom - 5);
+
+  for (let i = 0; i <= 4; i++) {
+    const v = vmax * i / 4;
+    svg.append(el("line", {x1: left, x2: w, y1: y(v), y2: y(v), stroke: "#eee"}));
+    svg.append(el("text", {x: left - 4, y: y(v) + 4, "text-anchor": "end"}, format(Math.round(v))));
+  }
+  for (const t of [t0, t1]) {
+    const label = new Date(t).toLocaleString([], {month: "2-digit", day: "2-digit", hour: "2-digit", minute: "2-digit"});
+    svg.append(el("text", {x: x(t), y: h - 4, "text-anchor": t === t0 ? "start" : "end"}, label));
+  }
+  const legend = el("div", {class: "legend"});
+  lines.forEach((l, i) => {
+    const color = colors[i % colors.length];
+    const d = l.points.map((p, j) => `${j ? "L" : "M"}${x(p[0])},${y(p[1])}`).join("");
+    svg.append(el("path", {d, fill: "none", stroke: color, "stroke-width": 1.5, "vector-effect": "non-scaling-stroke"}));
+    legend.append(el("span", {style: `--color: ${color}`}, l.name));
+  });
+  container.append(legend);
+}
+
+function table(t, head, rows) {
+  t.replaceChildren();
+  const tr = el("tr");
+  head.forEach(c => tr.append(el("th", {}, c)));
+  t.append(tr);
+  for (const row of rows) {
+    const tr = el("tr");
+    row.forEach(c => tr.append(el("td", {}, c)));
+    t.append(tr);
+  }
+}
+
+async function loadTraffic(kind, params) {
+  const [series, top] = await Promise.all([
+    get("api/series", {...params, kind}),
+    get("api/top", {...params, kind}),
+  ]);
+  chart(document.getElementById(`${kind}-chart`), series.series.map(s => ({
+    name: s.target,
+    points: s.points.map(p => [Date.parse(p.time), p.uplink + p.downlink]),
+  })), formatBytes);
+  table(document.getElementById(`${kind}-top`), [kind, "Uplink", "Downlink", "Total"],
+    top.map(u => [u.target, formatBytes(u.uplink), formatBytes(u.downlink), formatBytes(u.total)]));
+}
+
+async function loadSys(params) {
+  const points = await get("api/sys", params);
+  const byServer = new Map();
+  for (const p of points) {
+    if (!byServer.has(p.server)) byServer.set(p.server, []);
+    byServer.get(p.server).push(p);
+  }
+  chart(document.getElementById("sys-chart"), [...byServer].map(([server, ps]) => ({
+    name: `${server} alloc`,
+    points: ps.map(p => [Date.parse(p.time), p.alloc]),
+  })), formatBytes);
+  table(document.getElementById("sys-latest"), ["Server", "Uptime", "Goroutines", "Alloc", "Sys", "Live objects"],
+    [...byServer].map(([server, ps]) => {
+      const p = ps[ps.length - 1];
+      return [server, formatDuration(p.uptime), p.num_goroutine, formatBytes(p.alloc), formatBytes(p.sys), p.live_objects];
+    }));
+}
+
+async function load() {
+  const params = {window: document.getElementById("window").value};
+  const server = document.getElementById("server").value.trim();
+  if (server) params.server = server;
+  const error = document.getElementById("error");
+  try {
+    await Promise.all([loadTraffic("user", params), loadTraffic("inbound", params), loadSys(params)]);
+    error.textContent = "";
+  } catch (e) {
+    error.textContent = `Failed to load stats: ${e.message}`;
+  }
+}
+
+document.getElementById("window").addEventListener("change", load);
+document.getElementById("server").addEventListener("change", load);
+load();
+setInterval(load, 60000);
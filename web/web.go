@@ -0,0 +1,234 @@
+// Package web serves a dashboard of the traffic stored in the SQLite
+// database, along with the JSON endpoints it is built on.
+package web
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.rikki.moe/v2stat/internal/httpjson"
+	"go.rikki.moe/v2stat/stats"
+	"go.rikki.moe/v2stat/store"
+)
+
+//go:embed static
+var static embed.FS
+
+// maxPoints is the number of buckets a time series is split into at most.
+const maxPoints = 120
+
+// steps are the bucket sizes a time series may use.
+var steps = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+}
+
+// Handler serves the dashboard. Its endpoints are relative to the path it is
+// mounted on.
+type Handler struct {
+	db  *store.DB
+	log logrus.FieldLogger
+	mux *http.ServeMux
+}
+
+// New creates a dashboard reading from db.
+func New(db *store.DB, logger logrus.FieldLogger) *Handler {
+	h := &Handler{db: db, log: logger, mux: http.NewServeMux()}
+	assets, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	h.mux.Handle("GET /", http.FileServerFS(assets))
+	h.mux.HandleFunc("GET /api/series", h.series)
+	h.mux.HandleFunc("GET /api/top", h.top)
+	h.mux.HandleFunc("GET /api/sys", h.sys)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// point is the traffic of a target within a time bucket.
+type point struct {
+	Time     time.Time `json:"time"`
+	Uplink   int64     `json:"uplink"`
+	Downlink int64     `json:"downlink"`
+}
+
+type series struct {
+	Target string  `json:"target"`
+	Total  int64   `json:"total"`
+	Points []point `json:"points"`
+}
+
+// series returns the traffic over time of the targets of a kind with the
+// most traffic in the window.
+func (h *Handler) series(w http.ResponseWriter, r *http.Request) {
+	kind, from, to, ok := h.params(w, r)
+	if !ok {
+		return
+	}
+	limit, ok := limitParam(w, r)
+	if !ok {
+		return
+	}
+	step := stepFor(to.Sub(from))
+	from = from.Truncate(step)
+
+	points, err := h.db.Series(r.Context(), from, to, step, kind+stats.Separator, r.URL.Query().Get("server"))
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	byTarget := make(map[string]*series)
+	for _, p := range points {
+		name, ok := stats.ParseName(p.Name)
+		if !ok {
+			continue
+		}
+		s, ok := byTarget[name.Target]
+		if !ok {
+			s = &series{Target: name.Target}
+			byTarget[name.Target] = s
+		}
+		if n := len(s.Points); n == 0 || !s.Points[n-1].Time.Equal(p.Time) {
+			s.Points = append(s.Points, point{Time: p.Time})
+		}
+		last := &s.Points[len(s.Points)-1]
+		switch name.Direction {
+		case stats.DirectionUplink:
+			last.Uplink += p.Value
+		case stats.DirectionDownlink:
+			last.Downlink += p.Value
+		}
+		s.Total += p.Value
+	}
+
+	out := make([]series, 0, len(byTarget))
+	for _, s := range byTarget {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Total != out[j].Total {
+			return out[i].Total > out[j].Total
+		}
+		return out[i].Target < out[j].Target
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	httpjson.Write(w, struct {
+		From   time.Time `json:"from"`
+		To     time.Time `json:"to"`
+		Step   int64     `json:"step"`
+		Series []series  `json:"series"`
+	}{from, to, int64(step / time.Second), out})
+}
+
+// top returns the targets of a kind with the most traffic in the window.
+func (h *Handler) top(w http.ResponseWriter, r *http.Request) {
+	kind, from, to, ok := h.params(w, r)
+	if !ok {
+		return
+	}
+	limit, ok := limitParam(w, r)
+	if !ok {
+		return
+	}
+	totals, err := h.db.Totals(r.Context(), from, to, r.URL.Query().Get("server"))
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	out := []stats.Usage{}
+	for _, u := range stats.Aggregate(totals) {
+		if u.Kind == kind && len(out) < limit {
+			out = append(out, u)
+		}
+	}
+	httpjson.Write(w, out)
+}
+
+// sys returns the runtime state of every server over the window.
+func (h *Handler) sys(w http.ResponseWriter, r *http.Request) {
+	_, from, to, ok := h.params(w, r)
+	if !ok {
+		return
+	}
+	points, err := h.db.SysSeries(r.Context(), from, to, r.URL.Query().Get("server"))
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	if points == nil {
+		points = []store.SysPoint{}
+	}
+	httpjson.Write(w, points)
+}
+
+// params parses the kind and window parameters shared by the endpoints.
+// kind defaults to user and window to 24h.
+func (h *Handler) params(w http.ResponseWriter, r *http.Request) (string, time.Time, time.Time, bool) {
+	q := r.URL.Query()
+	kind := q.Get("kind")
+	switch kind {
+	case "":
+		kind = stats.KindUser
+	case stats.KindUser, stats.KindInbound, stats.KindOutbound:
+	default:
+		httpjson.Error(w, http.StatusBadRequest, fmt.Errorf("unknown kind %q", kind))
+		return "", time.Time{}, time.Time{}, false
+	}
+	window := 24 * time.Hour
+	if v := q.Get("window"); v != "" {
+		var err error
+		if window, err = stats.ParseDuration(v); err != nil {
+			httpjson.Error(w, http.StatusBadRequest, err)
+			return "", time.Time{}, time.Time{}, false
+		}
+	}
+	to := time.Now()
+	return kind, to.Add(-window), to, true
+}
+
+// limitParam parses the limit parameter, which defaults to 10.
+func limitParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return 10, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		httpjson.Error(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+		return 0, false
+	}
+	return n, true
+}
+
+// stepFor returns the smallest step splitting window into at most maxPoints
+// buckets.
+func stepFor(window time.Duration) time.Duration {
+	for _, s := range steps {
+		if window/s <= maxPoints {
+			return s
+		}
+	}
+	return steps[len(steps)-1]
+}
+
+func (h *Handler) fail(w http.ResponseWriter, err error) {
+	h.log.Errorf("Failed to query database: %v", err)
+	httpjson.Error(w, http.StatusInternalServerError, fmt.Errorf("failed to query database"))
+}
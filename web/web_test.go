@@ -0,0 +1,221 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.rikki.moe/v2stat/stats"
+	"go.rikki.moe/v2stat/store"
+)
+
+func statName(kind, target, direction string) string {
+	return kind + stats.Separator + target + stats.Separator + "traffic" + stats.Separator + direction
+}
+
+// newTestHandler creates a dashboard backed by a database holding the given
+// batches.
+func newTestHandler(t *testing.T, batches ...*stats.Batch) *Handler {
+	t.Helper()
+	db, err := store.Open(filepath.Join(t.TempDir(), "v2stat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, b := range batches {
+		if err := db.WriteBatch(context.Background(), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return New(db, logger)
+}
+
+// get requests path and decodes the response into v unless it is nil.
+func get(t *testing.T, h http.Handler, path string, v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if v != nil && w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	return w
+}
+
+func testBatches() []*stats.Batch {
+	now := time.Now()
+	return []*stats.Batch{
+		{Time: now.Add(-2 * time.Hour), Server: "s1", Stats: []stats.Stat{
+			{Name: statName(stats.KindUser, "alice@x", stats.DirectionUplink), Value: 100},
+			{Name: statName(stats.KindUser, "bob@x", stats.DirectionDownlink), Value: 300},
+			{Name: statName(stats.KindInbound, "vmess", stats.DirectionUplink), Value: 400},
+		}, Sys: &stats.SysStats{NumGoroutine: 10, Uptime: 60}},
+		{Time: now.Add(-time.Hour), Server: "s2", Stats: []stats.Stat{
+			{Name: statName(stats.KindUser, "alice@x", stats.DirectionDownlink), Value: 50},
+		}},
+		// Outside of the default window.
+		{Time: now.Add(-48 * time.Hour), Server: "s1", Stats: []stats.Stat{
+			{Name: statName(stats.KindUser, "carol@x", stats.DirectionUplink), Value: 1000},
+		}},
+	}
+}
+
+func TestTop(t *testing.T) {
+	h := newTestHandler(t, testBatches()...)
+	tests := []struct {
+		query string
+		want  []stats.Usage
+	}{
+		{"", []stats.Usage{
+			{Kind: stats.KindUser, Target: "bob@x", Downlink: 300},
+			{Kind: stats.KindUser, Target: "alice@x", Uplink: 100, Downlink: 50},
+		}},
+		{"?limit=1", []stats.Usage{{Kind: stats.KindUser, Target: "bob@x", Downlink: 300}}},
+		{"?server=s2", []stats.Usage{{Kind: stats.KindUser, Target: "alice@x", Downlink: 50}}},
+		{"?kind=inbound", []stats.Usage{{Kind: stats.KindInbound, Target: "vmess", Uplink: 400}}},
+		{"?kind=outbound", []stats.Usage{}},
+		{"?window=3d", []stats.Usage{
+			{Kind: stats.KindUser, Target: "carol@x", Uplink: 1000},
+			{Kind: stats.KindUser, Target: "bob@x", Downlink: 300},
+			{Kind: stats.KindUser, Target: "alice@x", Uplink: 100, Downlink: 50},
+		}},
+	}
+	for _, tt := range tests {
+		var got []struct {
+			stats.Usage
+			Total int64 `json:"total"`
+		}
+		w := get(t, h, "/api/top"+tt.query, &got)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got %d", tt.query, w.Code)
+			continue
+		}
+		if got == nil || len(got) != len(tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.query, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].Usage != tt.want[i] || got[i].Total != tt.want[i].Total() {
+				t.Errorf("%s: got %+v, want %+v", tt.query, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSeries(t *testing.T) {
+	h := newTestHandler(t, testBatches()...)
+	var got struct {
+		Step   int64    `json:"step"`
+		Series []series `json:"series"`
+	}
+	if w := get(t, h, "/api/series?window=6h", &got); w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	if got.Step != int64(5*time.Minute/time.Second) {
+		t.Errorf("step = %d, want 300 for a 6h window", got.Step)
+	}
+	if len(got.Series) != 2 || got.Series[0].Target != "bob@x" || got.Series[1].Target != "alice@x" {
+		t.Fatalf("got %+v, want bob@x and alice@x", got.Series)
+	}
+	alice := got.Series[1]
+	if alice.Total != 150 || len(alice.Points) != 2 {
+		t.Fatalf("alice = %+v, want 150 bytes in 2 points", alice)
+	}
+	if p := alice.Points[0]; p.Uplink != 100 || p.Downlink != 0 {
+		t.Errorf("first point of alice = %+v, want 100 up", p)
+	}
+	if p := alice.Points[1]; p.Uplink != 0 || p.Downlink != 50 || !p.Time.After(alice.Points[0].Time) {
+		t.Errorf("second point of alice = %+v, want 50 down after the first", p)
+	}
+	for _, p := range alice.Points {
+		if p.Time.Unix()%got.Step != 0 {
+			t.Errorf("point at %s not aligned to the step", p.Time)
+		}
+	}
+}
+
+func TestSys(t *testing.T) {
+	h := newTestHandler(t, testBatches()...)
+	var got []store.SysPoint
+	if w := get(t, h, "/api/sys", &got); w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	if len(got) != 1 || got[0].Server != "s1" || got[0].NumGoroutine != 10 || got[0].Uptime != 60 {
+		t.Errorf("got %+v, want the sample of s1", got)
+	}
+
+	got = nil
+	if w := get(t, h, "/api/sys?server=s2", &got); w.Code != http.StatusOK || got == nil || len(got) != 0 {
+		t.Errorf("got %d %+v, want an empty list", w.Code, got)
+	}
+}
+
+func TestRejectsParams(t *testing.T) {
+	h := newTestHandler(t)
+	for _, path := range []string{
+		"/api/top?kind=balancer",
+		"/api/top?window=x",
+		"/api/top?limit=0",
+		"/api/series?limit=-1",
+		"/api/series?window=1y",
+	} {
+		w := get(t, h, path, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", path, w.Code)
+		}
+		var body map[string]string
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body["error"] == "" {
+			t.Errorf("%s: got body %v, %v, want an error", path, body, err)
+		}
+	}
+}
+
+func TestStatic(t *testing.T) {
+	h := newTestHandler(t)
+	w := get(t, h, "/", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<html") {
+		t.Errorf("got %d, want the dashboard page", w.Code)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	h := BasicAuth(newTestHandler(t), "admin", "secret")
+	tests := []struct {
+		name           string
+		set            bool
+		user, password string
+		code           int
+	}{
+		{"missing", false, "", "", http.StatusUnauthorized},
+		{"wrong password", true, "admin", "wrong", http.StatusUnauthorized},
+		{"wrong user", true, "root", "secret", http.StatusUnauthorized},
+		{"empty password", true, "admin", "", http.StatusUnauthorized},
+		{"correct", true, "admin", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/top", nil)
+		if tt.set {
+			r.SetBasicAuth(tt.user, tt.password)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.code)
+		}
+		if w.Code == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+			t.Errorf("%s: WWW-Authenticate = %q", tt.name, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}